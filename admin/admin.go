@@ -0,0 +1,270 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/wzshiming/sshd"
+	"github.com/wzshiming/sshd/guard"
+)
+
+// Handler serves the admin control plane of a Server over HTTP
+//
+//	GET    /healthz                                  liveness probe
+//	GET    /readyz                                   readiness probe
+//	GET    /metrics                                  prometheus metrics, if enabled
+//	GET    /connections                              list connections
+//	GET    /connections/{id}                         show a connection
+//	DELETE /connections/{id}                         disconnect a connection
+//	DELETE /connections/{id}/channels/{channel}      close a channel
+//	DELETE /connections/{id}/forwards/{forward}      close a remote forward
+//	GET    /sessions                                 list session channels
+//	GET    /forwards                                 list remote forwards
+//	POST   /reload                                   reload authorized keys and configuration
+//	GET    /bans                                     list banned IPs
+//	DELETE /bans/{ip}                                lift a ban
+type Handler struct {
+	// Server is the server to control
+	Server *sshd.Server
+	// Guard is the brute-force guard of the server
+	// If nil, then no bans are listed
+	Guard *guard.Guard
+	// Reload is called by POST /reload
+	// If nil, then reload is not supported
+	Reload func() error
+	// Logger error log
+	Logger sshd.Logger
+
+	mux *http.ServeMux
+}
+
+// NewHandler returns a Handler for the server
+func NewHandler(server *sshd.Server) *Handler {
+	h := &Handler{
+		Server: server,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /healthz", h.healthz)
+	h.mux.HandleFunc("GET /readyz", h.readyz)
+	h.mux.HandleFunc("GET /metrics", h.metrics)
+	h.mux.HandleFunc("GET /connections", h.connections)
+	h.mux.HandleFunc("GET /connections/{id}", h.connection)
+	h.mux.HandleFunc("DELETE /connections/{id}", h.disconnect)
+	h.mux.HandleFunc("DELETE /connections/{id}/channels/{channel}", h.closeChannel)
+	h.mux.HandleFunc("DELETE /connections/{id}/forwards/{forward}", h.closeForward)
+	h.mux.HandleFunc("GET /sessions", h.sessions)
+	h.mux.HandleFunc("GET /forwards", h.forwards)
+	h.mux.HandleFunc("POST /reload", h.reload)
+	h.mux.HandleFunc("GET /bans", h.bans)
+	h.mux.HandleFunc("DELETE /bans/{ip}", h.unban)
+	return h
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// SessionInfo describes a session channel and the connection it belongs to
+type SessionInfo struct {
+	ConnID     string `json:"conn_id"`
+	User       string `json:"user"`
+	RemoteAddr string `json:"remote_addr"`
+	sshd.ChannelInfo
+}
+
+// ForwardInfo describes a remote forward and the connection it belongs to
+type ForwardInfo struct {
+	ConnID     string `json:"conn_id"`
+	User       string `json:"user"`
+	RemoteAddr string `json:"remote_addr"`
+	sshd.ForwardInfo
+}
+
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	if !h.Server.Ready() {
+		h.writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (h *Handler) metrics(w http.ResponseWriter, r *http.Request) {
+	h.Server.Metrics.ServeHTTP(w, r)
+}
+
+func (h *Handler) connections(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, http.StatusOK, h.Server.ConnInfos())
+}
+
+func (h *Handler) connection(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.Server.Conn(r.PathValue("id"))
+	if !ok {
+		h.writeError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+	h.writeJSON(w, http.StatusOK, c.Info())
+}
+
+func (h *Handler) disconnect(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	c, ok := h.Server.Conn(id)
+	if !ok {
+		h.writeError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+	if h.Logger != nil {
+		h.Logger.Println("admin disconnect:", id, c.User(), c.RemoteAddr())
+	}
+	c.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) closeChannel(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.Server.Conn(r.PathValue("id"))
+	if !ok {
+		h.writeError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+	err := c.CloseChannel(r.PathValue("channel"))
+	if err != nil {
+		h.writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) closeForward(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.Server.Conn(r.PathValue("id"))
+	if !ok {
+		h.writeError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+	err := c.CloseForward(r.PathValue("forward"))
+	if err != nil {
+		h.writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) sessions(w http.ResponseWriter, r *http.Request) {
+	sessions := []SessionInfo{}
+	for _, c := range h.Server.Conns() {
+		for _, ch := range c.OpenChannels() {
+			if ch.Type != "session" {
+				continue
+			}
+			sessions = append(sessions, SessionInfo{
+				ConnID:      c.ID,
+				User:        c.User(),
+				RemoteAddr:  c.RemoteAddr().String(),
+				ChannelInfo: ch.Info(),
+			})
+		}
+	}
+	h.writeJSON(w, http.StatusOK, sessions)
+}
+
+func (h *Handler) forwards(w http.ResponseWriter, r *http.Request) {
+	forwards := []ForwardInfo{}
+	for _, c := range h.Server.Conns() {
+		for _, f := range c.Forwards() {
+			forwards = append(forwards, ForwardInfo{
+				ConnID:      c.ID,
+				User:        c.User(),
+				RemoteAddr:  c.RemoteAddr().String(),
+				ForwardInfo: f.Info(),
+			})
+		}
+	}
+	h.writeJSON(w, http.StatusOK, forwards)
+}
+
+func (h *Handler) reload(w http.ResponseWriter, r *http.Request) {
+	if h.Reload == nil {
+		h.writeError(w, http.StatusNotImplemented, "reload not supported")
+		return
+	}
+	err := h.Reload()
+	if err != nil {
+		if h.Logger != nil {
+			h.Logger.Println("admin reload:", err)
+		}
+		h.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (h *Handler) bans(w http.ResponseWriter, r *http.Request) {
+	bans := []guard.Ban{}
+	if h.Guard != nil {
+		bans = h.Guard.Bans()
+	}
+	h.writeJSON(w, http.StatusOK, bans)
+}
+
+func (h *Handler) unban(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+	if h.Guard == nil || !h.Guard.Unban(ip) {
+		h.writeError(w, http.StatusNotFound, "ban not found")
+		return
+	}
+	if h.Logger != nil {
+		h.Logger.Println("admin unban:", ip)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, code int, msg string) {
+	h.writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil && h.Logger != nil {
+		h.Logger.Println("admin encode:", err)
+	}
+}
+
+// Listen listens on the unix socket for the address "unix:/path/to/socket",
+// otherwise on the tcp address which must be a loopback address
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		listener, err := listenUnix(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("admin address %q is not a loopback address", address)
+		}
+	}
+	return net.Listen("tcp", address)
+}
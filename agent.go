@@ -0,0 +1,157 @@
+package sshd
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// GetAgentHostkeys returns the keys held by the ssh-agent listening on the Unix socket as host keys,
+// the private keys never leave the agent and the socket is dialed again if the connection is lost
+func GetAgentHostkeys(socket string) ([]ssh.Signer, error) {
+	a := &agentConn{socket: socket}
+	keys, err := a.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in the agent at %s", socket)
+	}
+	signers := make([]ssh.Signer, 0, len(keys))
+	for _, key := range keys {
+		signers = append(signers, &agentSigner{agent: a, key: key})
+	}
+	return signers, nil
+}
+
+// GetSignerHostkeys returns host keys signing with the signers, such as keys held in a hardware token
+// or by a key management service, so the private keys never need to be on disk
+func GetSignerHostkeys(signers ...crypto.Signer) ([]ssh.Signer, error) {
+	keys := make([]ssh.Signer, 0, len(signers))
+	for _, signer := range signers {
+		key, err := ssh.NewSignerFromSigner(signer)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// agentConn is a connection to an ssh-agent that is dialed on demand
+type agentConn struct {
+	socket string
+
+	mut    sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+func (a *agentConn) dial() (agent.ExtendedAgent, error) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.client != nil {
+		return a.client, nil
+	}
+	conn, err := net.Dial("unix", a.socket)
+	if err != nil {
+		return nil, err
+	}
+	a.conn = conn
+	a.client = agent.NewClient(conn)
+	return a.client, nil
+}
+
+// reset closes the connection after a failure, so the next use dials again
+func (a *agentConn) reset(client agent.ExtendedAgent) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.client != client {
+		return
+	}
+	a.conn.Close()
+	a.conn = nil
+	a.client = nil
+}
+
+// do runs the function with the agent, retrying once on a new connection if the connection failed,
+// a refusal of the agent is returned as is
+func (a *agentConn) do(fun func(client agent.ExtendedAgent) error) error {
+	var err error
+	for i := 0; i != 2; i++ {
+		var client agent.ExtendedAgent
+		client, err = a.dial()
+		if err != nil {
+			continue
+		}
+		err = fun(client)
+		if err == nil || !isConnError(err) {
+			return err
+		}
+		a.reset(client)
+	}
+	return err
+}
+
+// isConnError reports whether the error is of the connection to the agent rather than from the agent
+func isConnError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+func (a *agentConn) list() ([]*agent.Key, error) {
+	var keys []*agent.Key
+	err := a.do(func(client agent.ExtendedAgent) error {
+		var err error
+		keys, err = client.List()
+		return err
+	})
+	return keys, err
+}
+
+// agentSigner signs with a key held by the agent
+type agentSigner struct {
+	agent *agentConn
+	key   ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case "", s.key.Type():
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	default:
+		return nil, fmt.Errorf("agent: unsupported algorithm %q for %s key", algorithm, s.key.Type())
+	}
+	var sig *ssh.Signature
+	err := s.agent.do(func(client agent.ExtendedAgent) error {
+		var err error
+		sig, err = client.SignWithFlags(s.key, data, flags)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("agent: %w", err)
+	}
+	return sig, nil
+}
@@ -0,0 +1,133 @@
+package sshd
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Audit event kinds
+const (
+	AuditAuth      = "auth"
+	AuditAuthorize = "authorize"
+)
+
+// AuditEvent records an authentication attempt or an authorization decision
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// Event is AuditAuth or AuditAuthorize
+	Event string `json:"event"`
+	// SessionID identifies the connection from its authentication on
+	SessionID  string `json:"session_id"`
+	ConnID     string `json:"conn_id,omitempty"`
+	User       string `json:"user"`
+	RemoteAddr string `json:"remote_addr"`
+	// Method is the authentication method of auth events
+	Method string `json:"method,omitempty"`
+	// Type and Args are those of the AuthorizeRequest of authorize events
+	Type string `json:"type,omitempty"`
+	Args string `json:"args,omitempty"`
+	// Detail is the command the client asked for with exec, the subsystem of subsystem
+	// or the variable name of env requests
+	Detail string `json:"detail,omitempty"`
+	// Command is the command run by exec and shell requests, which is the forced command if any
+	Command string `json:"command,omitempty"`
+	Allow   bool   `json:"allow"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// AuditSink records audit events
+type AuditSink interface {
+	Audit(event *AuditEvent) error
+}
+
+// JoinAuditSinks returns an AuditSink recording to all the non-nil sinks
+// If all are nil, then nil
+func JoinAuditSinks(sinks ...AuditSink) AuditSink {
+	var joined joinAuditSinks
+	for _, s := range sinks {
+		if s != nil {
+			joined = append(joined, s)
+		}
+	}
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
+
+type joinAuditSinks []AuditSink
+
+func (j joinAuditSinks) Audit(event *AuditEvent) error {
+	var errs []error
+	for _, s := range j {
+		err := s.Audit(event)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func newAuditEvent(kind string, conn ssh.ConnMetadata) *AuditEvent {
+	return &AuditEvent{
+		Time:       time.Now(),
+		Event:      kind,
+		SessionID:  hex.EncodeToString(conn.SessionID()),
+		User:       conn.User(),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+}
+
+// auditDetail returns what a session request asks for beyond its type
+func auditDetail(req *AuthorizeRequest) string {
+	r, ok := req.Msg.(*ssh.Request)
+	if !ok {
+		return ""
+	}
+	switch r.Type {
+	case "exec":
+		var msg ExecMsg
+		if ssh.Unmarshal(r.Payload, &msg) == nil {
+			return msg.Command
+		}
+	case "subsystem":
+		var msg SubsystemRequestMsg
+		if ssh.Unmarshal(r.Payload, &msg) == nil {
+			return msg.Subsystem
+		}
+	case "env":
+		var msg SetenvRequest
+		if ssh.Unmarshal(r.Payload, &msg) == nil {
+			return msg.Name
+		}
+	}
+	return ""
+}
+
+// auditCommand returns the command the session request runs, given the command it asked for
+func (s *ServerConn) auditCommand(req *AuthorizeRequest, asked string) string {
+	if req.Type != "session" || (req.Args != "exec" && req.Args != "shell") {
+		return ""
+	}
+	if cmd, ok := ForceCommand(s.ServerConn.Permissions); ok {
+		return cmd
+	}
+	return asked
+}
+
+// audit records the event, logging failures
+func (s *ServerConn) audit(event *AuditEvent) {
+	if s.Audit == nil {
+		return
+	}
+	err := s.Audit.Audit(event)
+	if err != nil && s.Logger != nil {
+		s.Logger.Println("unable to audit:", err)
+	}
+}
@@ -0,0 +1,200 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/wzshiming/sshd"
+)
+
+// hashField is appended to each line, hashing everything before it
+const hashField = `,"hash":"`
+
+// record is a line of the file, chained to the previous one by its hash
+type record struct {
+	*sshd.AuditEvent
+	Prev string `json:"prev"`
+}
+
+// File records audit events as JSON lines, each with the HMAC-SHA256 of the line and of the previous one
+// so that a line modified, removed or inserted afterwards breaks the chain checked by Verify
+//
+// The key must be kept where those who can write the file can not read it, with it the chain can be rewritten.
+// Lines cut from the end of the file leave a valid chain, they are only detected against a head recorded
+// elsewhere, such as the one returned by Head and logged when the file is reopened
+type File struct {
+	path string
+	key  []byte
+
+	mut  sync.Mutex
+	file *os.File
+	prev string
+}
+
+// NewFile opens the file for appending with the key, continuing the chain of the lines it already has
+func NewFile(path string, key []byte) (*File, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("no audit key")
+	}
+	prev, err := lastHash(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		path: path,
+		key:  key,
+		file: file,
+		prev: prev,
+	}, nil
+}
+
+func openFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// Audit appends the event to the file
+func (f *File) Audit(event *sshd.AuditEvent) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	data, err := json.Marshal(record{event, f.prev})
+	if err != nil {
+		return err
+	}
+	hash := lineHash(f.key, data)
+	line := make([]byte, 0, len(data)+len(hashField)+len(hash)+3)
+	line = append(line, data[:len(data)-1]...)
+	line = append(line, hashField...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+	_, err = f.file.Write(line)
+	if err != nil {
+		return err
+	}
+	f.prev = hash
+	return nil
+}
+
+// Head returns the hash of the last line, which Verify returns for an intact file
+func (f *File) Head() string {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.prev
+}
+
+// Reopen opens the file again, such as after it was rotated, the chain continues in the new file
+func (f *File) Reopen() error {
+	file, err := openFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.file.Close()
+	f.file = file
+	return nil
+}
+
+// Close closes the file
+func (f *File) Close() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.file.Close()
+}
+
+// lineHash is the hash of a line without its hash field
+func lineHash(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// splitLine returns the line without its hash field, as it was hashed, and the hash
+func splitLine(line []byte) ([]byte, string, error) {
+	i := bytes.LastIndex(line, []byte(hashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte("\"}")) {
+		return nil, "", fmt.Errorf("no hash")
+	}
+	hash := string(line[i+len(hashField) : len(line)-2])
+	data := append(line[:i:i], '}')
+	return data, hash, nil
+}
+
+// lastHash returns the hash of the last line of the file, or empty if there is none
+func lastHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) != 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if last == nil {
+		return "", nil
+	}
+	_, hash, err := splitLine(last)
+	if err != nil {
+		return "", fmt.Errorf("%s: last line: %w", path, err)
+	}
+	return hash, nil
+}
+
+// Verify checks the chain of the lines read with the key, starting from the hash prev, which is empty
+// for the first file, and returns the hash of the last line to verify the next file with
+// or to compare with a head recorded elsewhere
+func Verify(r io.Reader, key []byte, prev string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		data, hash, err := splitLine(line)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %w", n, err)
+		}
+		if !hmac.Equal([]byte(lineHash(key, data)), []byte(hash)) {
+			return "", fmt.Errorf("line %d: hash mismatch, the line was modified", n)
+		}
+		var rec struct {
+			Prev string `json:"prev"`
+		}
+		err = json.Unmarshal(data, &rec)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %w", n, err)
+		}
+		if rec.Prev != prev {
+			return "", fmt.Errorf("line %d: chain broken, a line was removed or inserted before it", n)
+		}
+		prev = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return prev, nil
+}
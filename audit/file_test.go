@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wzshiming/sshd"
+)
+
+var testKey = []byte("test audit key")
+
+func writeTestFile(t *testing.T, path string, users ...string) {
+	t.Helper()
+	f, err := NewFile(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, user := range users {
+		err := f.Audit(&sshd.AuditEvent{
+			Time:       time.Unix(0, 0).UTC(),
+			Event:      sshd.AuditAuthorize,
+			User:       user,
+			RemoteAddr: "127.0.0.1:50000",
+			Type:       "session",
+			Allow:      true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestFile(t, path, "alice", "bob")
+	// Opened again, the file continues the chain
+	writeTestFile(t, path, "carol", "dave")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines = lines[:len(lines)-1]
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4", len(lines))
+	}
+
+	tests := []struct {
+		name  string
+		lines []string
+		err   string
+	}{
+		{"intact", lines, ""},
+		{"empty", nil, ""},
+		{"blank lines", []string{lines[0], "\n", lines[1], lines[2], lines[3]}, ""},
+		{"modified", []string{lines[0], strings.Replace(lines[1], "bob", "eve", 1), lines[2], lines[3]}, "line 2: hash mismatch"},
+		{"removed", []string{lines[0], lines[2], lines[3]}, "line 2: chain broken"},
+		{"removed first", lines[1:], "line 1: chain broken"},
+		{"inserted", []string{lines[0], lines[1], lines[1], lines[2], lines[3]}, "line 3: chain broken"},
+		{"reordered", []string{lines[0], lines[2], lines[1], lines[3]}, "line 2: chain broken"},
+		{"no hash", []string{lines[0], "{\"user\":\"eve\"}\n"}, "line 2: no hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last, err := Verify(strings.NewReader(strings.Join(tt.lines, "")), testKey, "")
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Verify() = %v", err)
+				}
+				want := ""
+				if len(tt.lines) != 0 {
+					_, want, _ = splitLine(bytes.TrimSuffix([]byte(tt.lines[len(tt.lines)-1]), []byte("\n")))
+				}
+				if last != want {
+					t.Errorf("Verify() = %q, want %q", last, want)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("Verify() = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyRotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	rotated := filepath.Join(dir, "audit.log.1")
+
+	f, err := NewFile(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	event := &sshd.AuditEvent{Event: sshd.AuditAuth, User: "alice", Method: "publickey", Allow: true}
+	if err := f.Audit(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Audit(event); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := os.ReadFile(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := Verify(bytes.NewReader(first), testKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(bytes.NewReader(second), testKey, prev); err != nil {
+		t.Errorf("Verify() of the file after rotation = %v", err)
+	}
+	if _, err := Verify(bytes.NewReader(second), testKey, ""); err == nil {
+		t.Error("Verify() of the file after rotation from the start succeeded")
+	}
+	if head, _ := Verify(bytes.NewReader(second), testKey, prev); head != f.Head() {
+		t.Errorf("Verify() = %q, want the head %q", head, f.Head())
+	}
+}
+
+func TestVerifyKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestFile(t, path, "alice", "bob")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(bytes.NewReader(data), []byte("other key"), ""); err == nil {
+		t.Error("Verify() with another key succeeded")
+	}
+
+	// Without the key, a modified line can not be given a valid hash
+	lines := strings.SplitAfter(string(data), "\n")
+	line, _, err := splitLine([]byte(strings.TrimSuffix(strings.Replace(lines[1], "bob", "eve", 1), "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := string(line[:len(line)-1]) + hashField + lineHash([]byte("guessed key"), line) + "\"}\n"
+	if _, err := Verify(strings.NewReader(lines[0]+forged), testKey, ""); err == nil {
+		t.Error("Verify() of a line hashed with another key succeeded")
+	}
+
+	if _, err := NewFile(path, nil); err == nil {
+		t.Error("NewFile() without key succeeded")
+	}
+}
@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+
+	"github.com/wzshiming/sshd"
+)
+
+// Syslog records audit events as JSON to the system log, denials with warning priority
+type Syslog struct {
+	writer *syslog.Writer
+}
+
+// NewSyslog connects to the local system log with the tag
+func NewSyslog(tag string) (*Syslog, error) {
+	writer, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &Syslog{writer}, nil
+}
+
+// Audit writes the event to the system log
+func (s *Syslog) Audit(event *sshd.AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if !event.Allow {
+		return s.writer.Warning(string(data))
+	}
+	return s.writer.Info(string(data))
+}
+
+// Close closes the connection to the system log
+func (s *Syslog) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,27 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"fmt"
+
+	"github.com/wzshiming/sshd"
+)
+
+// Syslog records audit events to the system log, which is not supported on this platform
+type Syslog struct{}
+
+// NewSyslog returns an error, there is no system log on this platform
+func NewSyslog(tag string) (*Syslog, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
+
+// Audit does nothing
+func (s *Syslog) Audit(event *sshd.AuditEvent) error {
+	return nil
+}
+
+// Close does nothing
+func (s *Syslog) Close() error {
+	return nil
+}
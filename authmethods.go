@@ -0,0 +1,414 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthenticationMethods requires combinations of authentication methods like
+// OpenSSH's AuthenticationMethods, chaining the callbacks of ssh.ServerConfig
+// with ssh.PartialSuccessError
+type AuthenticationMethods struct {
+	// Rules are matched in order and the first matching rule applies
+	Rules []AuthenticationMethodsRule
+	// Default is used when no rule matches
+	// If nil, then any single method is enough
+	Default [][]string
+	// Groups returns the groups of the user
+	// If nil, then the groups of the system user are used
+	Groups func(user string) ([]string, error)
+}
+
+// AuthenticationMethodsRule lists the accepted method combinations for matching connections
+type AuthenticationMethodsRule struct {
+	// Users is the pattern list of the usernames, empty matches any
+	Users string
+	// Groups is the pattern list of the groups of the user, empty matches any
+	Groups string
+	// From is the address list of the client, empty matches any
+	From string
+	// Methods are the alternative lists of methods, each to be completed in order
+	Methods [][]string
+}
+
+// ParseAuthenticationMethods parses the space separated lists of comma separated methods,
+// such as "publickey,password publickey,keyboard-interactive"
+func ParseAuthenticationMethods(s string) ([][]string, error) {
+	var lists [][]string
+	for _, field := range strings.Fields(s) {
+		list := strings.Split(field, ",")
+		for _, method := range list {
+			switch method {
+			case "publickey", "password", "keyboard-interactive":
+			default:
+				return nil, fmt.Errorf("unsupported authentication method %q", method)
+			}
+		}
+		lists = append(lists, list)
+	}
+	if len(lists) == 0 {
+		return nil, fmt.Errorf("no authentication methods")
+	}
+	return lists, nil
+}
+
+// Apply replaces the password, public key and keyboard-interactive callbacks of the config
+// with ones that require the method combinations, the callbacks must not return
+// ssh.PartialSuccessError themselves
+// NoClientAuth is turned off, the none method would skip the combinations
+func (a *AuthenticationMethods) Apply(config *ssh.ServerConfig) {
+	config.NoClientAuth = false
+	config.NoClientAuthCallback = nil
+	callbacks := ssh.ServerAuthCallbacks{
+		PasswordCallback:            config.PasswordCallback,
+		PublicKeyCallback:           config.PublicKeyCallback,
+		KeyboardInteractiveCallback: config.KeyboardInteractiveCallback,
+	}
+	chain := &authChain{
+		policy:    a,
+		callbacks: callbacks,
+	}
+	next := chain.next(nil, nil)
+	config.PasswordCallback = next.PasswordCallback
+	config.PublicKeyCallback = next.PublicKeyCallback
+	config.KeyboardInteractiveCallback = next.KeyboardInteractiveCallback
+}
+
+// Methods returns the method combinations required for the connection
+func (a *AuthenticationMethods) Methods(conn ssh.ConnMetadata) [][]string {
+	for _, rule := range a.Rules {
+		if a.match(&rule, conn) {
+			return rule.Methods
+		}
+	}
+	return a.Default
+}
+
+func (a *AuthenticationMethods) match(rule *AuthenticationMethodsRule, conn ssh.ConnMetadata) bool {
+	if rule.Users != "" && !MatchPatternList(rule.Users, conn.User()) {
+		return false
+	}
+	if rule.From != "" {
+		ip := remoteIP(conn.RemoteAddr())
+		if ip == nil || !MatchAddrList(rule.From, ip) {
+			return false
+		}
+	}
+	if rule.Groups != "" {
+		groups, err := a.groups(conn.User())
+		if err != nil {
+			return false
+		}
+		matched := false
+		for _, group := range groups {
+			if MatchPatternList(rule.Groups, group) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *AuthenticationMethods) groups(name string) ([]string, error) {
+	if a.Groups != nil {
+		return a.Groups(name)
+	}
+	return UserGroups(name)
+}
+
+// UserGroups returns the names of the groups of the system user
+func UserGroups(name string) ([]string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if g, err := user.LookupGroupId(id); err == nil {
+			groups = append(groups, g.Name)
+		}
+	}
+	return groups, nil
+}
+
+// authChain builds the callbacks of each authentication step
+type authChain struct {
+	policy    *AuthenticationMethods
+	callbacks ssh.ServerAuthCallbacks
+}
+
+// next returns the callbacks for the step after the methods done
+func (c *authChain) next(done []string, perms *ssh.Permissions) ssh.ServerAuthCallbacks {
+	var next ssh.ServerAuthCallbacks
+	if c.callbacks.PasswordCallback != nil {
+		next.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if err := c.allowed(conn, done, "password"); err != nil {
+				return nil, err
+			}
+			p, err := c.callbacks.PasswordCallback(conn, password)
+			return c.step(conn, done, perms, "password", p, err)
+		}
+	}
+	if c.callbacks.PublicKeyCallback != nil {
+		next.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if err := c.allowed(conn, done, "publickey"); err != nil {
+				return nil, err
+			}
+			p, err := c.callbacks.PublicKeyCallback(conn, key)
+			return c.step(conn, done, perms, "publickey", p, err)
+		}
+	}
+	if c.callbacks.KeyboardInteractiveCallback != nil {
+		next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if err := c.allowed(conn, done, "keyboard-interactive"); err != nil {
+				return nil, err
+			}
+			p, err := c.callbacks.KeyboardInteractiveCallback(conn, client)
+			return c.step(conn, done, perms, "keyboard-interactive", p, err)
+		}
+	}
+	return next
+}
+
+// remaining returns the method lists that start with the methods done
+func (c *authChain) remaining(conn ssh.ConnMetadata, done []string) [][]string {
+	lists := c.policy.Methods(conn)
+	if lists == nil {
+		return nil
+	}
+	remaining := [][]string{}
+	for _, list := range lists {
+		if len(list) < len(done) {
+			continue
+		}
+		prefix := true
+		for i, method := range done {
+			if list[i] != method {
+				prefix = false
+				break
+			}
+		}
+		if prefix {
+			remaining = append(remaining, list)
+		}
+	}
+	return remaining
+}
+
+// allowed reports an error if the method can not be the next one after the methods done
+func (c *authChain) allowed(conn ssh.ConnMetadata, done []string, method string) error {
+	remaining := c.remaining(conn, done)
+	if remaining == nil {
+		return nil
+	}
+	for _, list := range remaining {
+		if len(list) > len(done) && list[len(done)] == method {
+			return nil
+		}
+	}
+	return fmt.Errorf("authentication method %q not allowed after %q", method, done)
+}
+
+// step completes the method and returns the final permissions,
+// or a partial success with the callbacks of the next step
+func (c *authChain) step(conn ssh.ConnMetadata, done []string, perms *ssh.Permissions, method string, p *ssh.Permissions, err error) (*ssh.Permissions, error) {
+	if err != nil {
+		return nil, err
+	}
+	perms, err = mergeAuthPermissions(perms, p)
+	if err != nil {
+		return nil, err
+	}
+	done = append(done[:len(done):len(done)], method)
+	remaining := c.remaining(conn, done)
+	if remaining == nil {
+		return perms, nil
+	}
+	methods := map[string]bool{}
+	for _, list := range remaining {
+		if len(list) == len(done) {
+			return perms, nil
+		}
+		methods[list[len(done)]] = true
+	}
+
+	// Only the methods that can follow are offered to the client
+	next := c.next(done, perms)
+	if !methods["password"] {
+		next.PasswordCallback = nil
+	}
+	if !methods["publickey"] {
+		next.PublicKeyCallback = nil
+	}
+	if !methods["keyboard-interactive"] {
+		next.KeyboardInteractiveCallback = nil
+	}
+	return nil, &ssh.PartialSuccessError{
+		Next: next,
+	}
+}
+
+// mergeAuthPermissions intersects the permissions granted by two authentication steps,
+// so that each step's restrictions still apply: critical options are united,
+// the permit-* extensions and the permitopen and permitlisten lists must allow in both,
+// and the environment of both is set
+func mergeAuthPermissions(perms, p *ssh.Permissions) (*ssh.Permissions, error) {
+	if perms == nil {
+		return p, nil
+	}
+	if p == nil {
+		return perms, nil
+	}
+	merged := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	for k, v := range perms.CriticalOptions {
+		merged.CriticalOptions[k] = v
+	}
+	for k, v := range p.CriticalOptions {
+		if cur, ok := merged.CriticalOptions[k]; ok {
+			if k == OptionForceCommand && cur != v {
+				return nil, fmt.Errorf("authentication steps force different commands")
+			}
+			continue
+		}
+		merged.CriticalOptions[k] = v
+	}
+
+	for k, v := range perms.Extensions {
+		if !isRestriction(k) {
+			merged.Extensions[k] = v
+		}
+	}
+	for k, v := range p.Extensions {
+		if isRestriction(k) {
+			continue
+		}
+		if cur, ok := merged.Extensions[k]; ok {
+			if k == ExtensionEnvironment {
+				merged.Extensions[k] = cur + "\n" + v
+			}
+			continue
+		}
+		merged.Extensions[k] = v
+	}
+
+	_, restricted := perms.Extensions[ExtensionRestricted]
+	_, pRestricted := p.Extensions[ExtensionRestricted]
+	switch {
+	case restricted && pRestricted:
+		merged.Extensions[ExtensionRestricted] = ""
+		for k, v := range perms.Extensions {
+			if _, ok := p.Extensions[k]; ok && strings.HasPrefix(k, "permit-") {
+				merged.Extensions[k] = v
+			}
+		}
+		for _, k := range []string{ExtensionPermitOpen, ExtensionPermitListen} {
+			a, aok := perms.Extensions[k]
+			b, bok := p.Extensions[k]
+			switch {
+			case aok && bok:
+				merged.Extensions[k] = strings.Join(intersectHostPorts(strings.Split(a, "\n"), strings.Split(b, "\n")), "\n")
+			case aok:
+				merged.Extensions[k] = a
+			case bok:
+				merged.Extensions[k] = b
+			}
+		}
+	case restricted:
+		copyRestrictions(merged, perms)
+	case pRestricted:
+		copyRestrictions(merged, p)
+	}
+	return merged, nil
+}
+
+// isRestriction reports whether the extension is enforced by ExtensionsPermissions
+func isRestriction(k string) bool {
+	return k == ExtensionRestricted || k == ExtensionPermitOpen || k == ExtensionPermitListen ||
+		strings.HasPrefix(k, "permit-")
+}
+
+func copyRestrictions(dst, src *ssh.Permissions) {
+	for k, v := range src.Extensions {
+		if isRestriction(k) {
+			dst.Extensions[k] = v
+		}
+	}
+}
+
+// intersectHostPorts returns the [host:]port permits matching what both lists match,
+// or "none", which matches nothing, if there is no such permit
+func intersectHostPorts(a, b []string) []string {
+	var out []string
+	for _, pa := range a {
+		hostA, portA := splitPermit(pa)
+		for _, pb := range b {
+			hostB, portB := splitPermit(pb)
+			port, ok := intersectPattern(portA, portB)
+			if !ok {
+				continue
+			}
+			host, ok := intersectPermitHost(hostA, hostB)
+			if !ok {
+				continue
+			}
+			if host == "*" {
+				out = append(out, port)
+			} else {
+				out = append(out, net.JoinHostPort(host, port))
+			}
+		}
+	}
+	if len(out) == 0 {
+		return []string{"none"}
+	}
+	return out
+}
+
+func splitPermit(permit string) (host, port string) {
+	host, port, err := net.SplitHostPort(permit)
+	if err != nil {
+		return "*", permit
+	}
+	if host == "" {
+		host = "*"
+	}
+	return host, port
+}
+
+func intersectPattern(a, b string) (string, bool) {
+	switch {
+	case a == "*":
+		return b, true
+	case b == "*", strings.EqualFold(a, b):
+		return a, true
+	}
+	return "", false
+}
+
+func intersectPermitHost(a, b string) (string, bool) {
+	if host, ok := intersectPattern(a, b); ok {
+		return host, true
+	}
+	switch {
+	case a == "localhost" && isLoopback(b):
+		return b, true
+	case b == "localhost" && isLoopback(a):
+		return a, true
+	}
+	return "", false
+}
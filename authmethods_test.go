@@ -0,0 +1,231 @@
+package sshd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c *testConnMetadata) User() string { return c.user }
+
+func TestMergeAuthPermissions(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b       *ssh.Permissions
+		err        bool
+		allow      map[string]bool
+		command    string
+		restricted bool
+	}{
+		{
+			name: "unrestricted with unrestricted",
+			a:    &ssh.Permissions{},
+			b:    nil,
+			allow: map[string]bool{
+				"direct-tcpip example.com:22": true,
+			},
+		},
+		{
+			name:       "restricted with unrestricted",
+			a:          &ssh.Permissions{Extensions: map[string]string{"other": ""}},
+			b:          (&KeyOptions{NoPty: true, PermitOpen: []string{"example.com:22"}}).Permissions(),
+			restricted: true,
+			allow: map[string]bool{
+				"direct-tcpip example.com:22": true,
+				"direct-tcpip example.com:80": false,
+				"session pty-req":             false,
+				"session x11-req":             true,
+			},
+		},
+		{
+			name:       "unrestricted with restricted",
+			a:          (&KeyOptions{NoPortForwarding: true}).Permissions(),
+			b:          &ssh.Permissions{},
+			restricted: true,
+			allow: map[string]bool{
+				"direct-tcpip example.com:22": false,
+				"session pty-req":             true,
+			},
+		},
+		{
+			name:       "permit-* of both",
+			a:          (&KeyOptions{NoPty: true}).Permissions(),
+			b:          (&KeyOptions{NoX11Forwarding: true}).Permissions(),
+			restricted: true,
+			allow: map[string]bool{
+				"session pty-req":                    false,
+				"session x11-req":                    false,
+				"session auth-agent-req@openssh.com": true,
+			},
+		},
+		{
+			name:       "permitopen with permitopen",
+			a:          (&KeyOptions{PermitOpen: []string{"*:22", "localhost:80", "example.com:*"}}).Permissions(),
+			b:          (&KeyOptions{PermitOpen: []string{"127.0.0.1:*", "example.com:443"}}).Permissions(),
+			restricted: true,
+			allow: map[string]bool{
+				"direct-tcpip 127.0.0.1:22":    true,
+				"direct-tcpip 127.0.0.1:80":    true,
+				"direct-tcpip 127.0.0.1:443":   false,
+				"direct-tcpip example.com:443": true,
+				"direct-tcpip example.com:22":  false,
+				"direct-tcpip localhost:22":    false,
+			},
+		},
+		{
+			name:       "disjoint permitlisten",
+			a:          (&KeyOptions{PermitListen: []string{"8080"}}).Permissions(),
+			b:          (&KeyOptions{PermitListen: []string{"localhost:9090"}}).Permissions(),
+			restricted: true,
+			allow: map[string]bool{
+				"tcpip-forward :8080":          false,
+				"tcpip-forward localhost:9090": false,
+				"direct-tcpip example.com:22":  true,
+			},
+		},
+		{
+			name:       "permitopen of one",
+			a:          (&KeyOptions{}).Permissions(),
+			b:          (&KeyOptions{PermitOpen: []string{"example.com:22"}}).Permissions(),
+			restricted: true,
+			allow: map[string]bool{
+				"direct-tcpip example.com:22": true,
+				"direct-tcpip example.com:23": false,
+			},
+		},
+		{
+			name:       "same force-command",
+			a:          (&KeyOptions{Command: "true"}).Permissions(),
+			b:          (&KeyOptions{Command: "true"}).Permissions(),
+			command:    "true",
+			restricted: true,
+		},
+		{
+			name:    "force-command of one",
+			a:       &ssh.Permissions{},
+			b:       &ssh.Permissions{CriticalOptions: map[string]string{OptionForceCommand: "true"}},
+			command: "true",
+		},
+		{
+			name: "conflicting force-command",
+			a:    (&KeyOptions{Command: "true"}).Permissions(),
+			b:    (&KeyOptions{Command: "false"}).Permissions(),
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeAuthPermissions(tt.a, tt.b)
+			if tt.err {
+				if err == nil {
+					t.Fatal("mergeAuthPermissions() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd, _ := ForceCommand(got); cmd != tt.command {
+				t.Errorf("ForceCommand() = %q, want %q", cmd, tt.command)
+			}
+			perms := ExtensionsPermissions(got)
+			if (perms != nil) != tt.restricted {
+				t.Fatalf("restricted = %v, want %v", perms != nil, tt.restricted)
+			}
+			for req, want := range tt.allow {
+				typ, args, _ := strings.Cut(req, " ")
+				allow := perms == nil || perms.Allow(typ, args)
+				if allow != want {
+					t.Errorf("Allow(%s) = %v, want %v", req, allow, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeAuthPermissionsEnvironment(t *testing.T) {
+	got, err := mergeAuthPermissions(
+		(&KeyOptions{Environment: []string{"A=1"}}).Permissions(),
+		(&KeyOptions{Environment: []string{"B=2"}}).Permissions(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := Environment(got); !reflect.DeepEqual(env, []string{"A=1", "B=2"}) {
+		t.Errorf("Environment() = %q", env)
+	}
+}
+
+func TestAuthenticationMethodsChain(t *testing.T) {
+	granted := &ssh.Permissions{CriticalOptions: map[string]string{OptionForceCommand: "true"}}
+	config := &ssh.ServerConfig{
+		NoClientAuth: true,
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("denied")
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return granted, nil
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	methods := &AuthenticationMethods{
+		Default: [][]string{{"publickey", "password"}, {"publickey", "keyboard-interactive", "password"}},
+	}
+	methods.Apply(config)
+	if config.NoClientAuth {
+		t.Error("NoClientAuth is still set")
+	}
+	conn := &testConnMetadata{user: "alice"}
+
+	// Only publickey can come first
+	if _, err := config.PasswordCallback(conn, []byte("secret")); err == nil {
+		t.Error("password first succeeded")
+	}
+	if _, err := config.KeyboardInteractiveCallback(conn, nil); err == nil {
+		t.Error("keyboard-interactive first succeeded")
+	}
+
+	_, err := config.PublicKeyCallback(conn, nil)
+	var partial *ssh.PartialSuccessError
+	if !errors.As(err, &partial) {
+		t.Fatalf("publickey = %v, want a partial success", err)
+	}
+	next := partial.Next
+	if next.PublicKeyCallback != nil {
+		t.Error("publickey is offered again")
+	}
+	if next.PasswordCallback == nil || next.KeyboardInteractiveCallback == nil {
+		t.Fatal("password and keyboard-interactive are not offered after publickey")
+	}
+	if _, err := next.PasswordCallback(conn, []byte("wrong")); err == nil || errors.As(err, &partial) {
+		t.Errorf("wrong password = %v, want a failure", err)
+	}
+	perms, err := next.PasswordCallback(conn, []byte("secret"))
+	if err != nil {
+		t.Fatalf("password after publickey = %v", err)
+	}
+	if cmd, _ := ForceCommand(perms); cmd != "true" {
+		t.Errorf("the permissions of publickey are lost, ForceCommand() = %q", cmd)
+	}
+
+	_, err = next.KeyboardInteractiveCallback(conn, nil)
+	if !errors.As(err, &partial) {
+		t.Fatalf("keyboard-interactive after publickey = %v, want a partial success", err)
+	}
+	if partial.Next.PasswordCallback == nil || partial.Next.PublicKeyCallback != nil || partial.Next.KeyboardInteractiveCallback != nil {
+		t.Error("only password should be offered after publickey,keyboard-interactive")
+	}
+}
@@ -0,0 +1,45 @@
+package sshd
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedFile is an authorized_keys file that can be reloaded atomically,
+// authentications in progress keep using the keys they started with
+type AuthorizedFile struct {
+	path string
+	keys atomic.Pointer[Authorized]
+}
+
+// NewAuthorizedFile loads the file
+func NewAuthorizedFile(path string) (*AuthorizedFile, error) {
+	f := &AuthorizedFile{path: path}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again, keeping the previous keys if it fails
+func (f *AuthorizedFile) Reload() error {
+	keys, err := GetAuthorizedFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.keys.Store(keys)
+	return nil
+}
+
+// Authorized returns the keys currently loaded
+func (f *AuthorizedFile) Authorized() *Authorized {
+	return f.keys.Load()
+}
+
+// PublicKeyCallback authenticates the key with the keys currently loaded,
+// it can be used as ssh.ServerConfig.PublicKeyCallback
+func (f *AuthorizedFile) PublicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	return f.Authorized().PublicKeyCallback(conn, key)
+}
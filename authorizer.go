@@ -0,0 +1,102 @@
+package sshd
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultDenyReason is the reason of denials that give none
+const DefaultDenyReason = "administratively prohibited"
+
+// AuthorizeRequest is a channel or request of a connection to authorize
+type AuthorizeRequest struct {
+	// Type is the channel or request type, such as session, direct-tcpip or tcpip-forward
+	Type string
+	// Args is what Permissions.Allow is asked with: the host:port of direct-tcpip and tcpip-forward,
+	// the socket path of streamlocal, the request type of a session request
+	// or empty for the session channel itself
+	Args string
+	// Msg is the parsed message, such as *ChannelOpenDirectMsg, *ForwardMsg,
+	// *StreamLocalChannelOpenDirectMsg or *StreamLocalChannelForwardMsg,
+	// or the *ssh.Request of a session request
+	// If nil, then the request has no message
+	Msg interface{}
+}
+
+// Decision is the outcome of an authorization
+type Decision struct {
+	Allow bool
+	// Reason explains the decision, it is logged and sent to the client in rejections
+	Reason string
+}
+
+// Authorizer decides the channels and requests of connections
+type Authorizer interface {
+	// Authorize decides the request of the connection, which is the *ServerConn
+	Authorize(ctx context.Context, conn ssh.ConnMetadata, req *AuthorizeRequest) Decision
+}
+
+// AuthorizerFunc is an Authorizer function
+type AuthorizerFunc func(ctx context.Context, conn ssh.ConnMetadata, req *AuthorizeRequest) Decision
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, conn ssh.ConnMetadata, req *AuthorizeRequest) Decision {
+	return f(ctx, conn, req)
+}
+
+// PermissionsAuthorizer returns an Authorizer asking the permissions with the type and args of requests,
+// permissions that also implement Authorizer are used as such to give their reason
+func PermissionsAuthorizer(perms Permissions) Authorizer {
+	if a, ok := perms.(Authorizer); ok {
+		return a
+	}
+	return permissionsAuthorizer{perms}
+}
+
+type permissionsAuthorizer struct {
+	perms Permissions
+}
+
+func (p permissionsAuthorizer) Authorize(ctx context.Context, conn ssh.ConnMetadata, req *AuthorizeRequest) Decision {
+	if !p.perms.Allow(req.Type, req.Args) {
+		return Decision{Allow: false, Reason: DefaultDenyReason}
+	}
+	return Decision{Allow: true}
+}
+
+// Authorize decides the request by the Permissions and then the Authorizer of the connection,
+// logging denials with their reason and auditing the decisions
+func (s *ServerConn) Authorize(ctx context.Context, req *AuthorizeRequest) Decision {
+	decision := Decision{Allow: true}
+	if s.Permissions != nil {
+		decision = PermissionsAuthorizer(s.Permissions).Authorize(ctx, s, req)
+	}
+	if decision.Allow && s.Authorizer != nil {
+		decision = s.Authorizer.Authorize(ctx, s, req)
+	}
+	if !decision.Allow && decision.Reason == "" {
+		decision.Reason = DefaultDenyReason
+	}
+	// Allowed housekeeping requests are too frequent and grant too little to be worth recording
+	if s.Audit != nil && !(decision.Allow && req.Type == "session" && IsHousekeeping(req.Args)) {
+		event := newAuditEvent(AuditAuthorize, s)
+		event.ConnID = s.ID
+		event.Type = req.Type
+		event.Args = req.Args
+		event.Detail = auditDetail(req)
+		event.Command = s.auditCommand(req, event.Detail)
+		event.Allow = decision.Allow
+		event.Reason = decision.Reason
+		s.audit(event)
+	}
+	if !decision.Allow {
+		if s.Logger != nil {
+			if req.Args != "" {
+				s.Logger.Println("prohibited:", req.Type, req.Args, "for", s.User(), "from", s.RemoteAddr(), decision.Reason)
+			} else {
+				s.Logger.Println("prohibited:", req.Type, "for", s.User(), "from", s.RemoteAddr(), decision.Reason)
+			}
+		}
+	}
+	return decision
+}
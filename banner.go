@@ -0,0 +1,171 @@
+package sshd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BannerData is the data a Banner template is executed with
+type BannerData struct {
+	User          string
+	RemoteAddr    string
+	LocalAddr     string
+	ClientVersion string
+	Time          time.Time
+}
+
+// Banner is a message shown to clients before authentication, as a text/template of BannerData
+type Banner struct {
+	template *template.Template
+}
+
+// NewBanner parses the text of the banner, text without actions is shown as it is
+func NewBanner(text string) (*Banner, error) {
+	t, err := template.New("banner").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Banner{t}, nil
+}
+
+// GetBannerFile reads the banner of a file
+func GetBannerFile(file string) (*Banner, error) {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewBanner(string(text))
+}
+
+// BannerCallback returns the banner for the connection, it can be used as ssh.ServerConfig.BannerCallback
+func (b *Banner) BannerCallback(conn ssh.ConnMetadata) string {
+	var buf bytes.Buffer
+	err := b.template.Execute(&buf, BannerData{
+		User:          conn.User(),
+		RemoteAddr:    conn.RemoteAddr().String(),
+		LocalAddr:     conn.LocalAddr().String(),
+		ClientVersion: string(conn.ClientVersion()),
+		Time:          time.Now(),
+	})
+	if err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// Motd is the message of the day shown to interactive sessions, followed by the last login of the user
+type Motd struct {
+	// Path is the file of the message, read for every session so changes apply at once
+	// If empty, then no message is shown
+	Path string
+	// LastLog records the logins of the users
+	// If nil, then the last login is not shown
+	LastLog *LastLog
+}
+
+// Message returns the message for the connection and records its login
+func (m *Motd) Message(conn *ServerConn) string {
+	var buf strings.Builder
+	if m.Path != "" {
+		text, err := os.ReadFile(m.Path)
+		if err != nil && conn.Logger != nil {
+			conn.Logger.Println("unable to read motd:", err)
+		}
+		buf.Write(text)
+	}
+	if m.LastLog != nil {
+		last, ok := m.LastLog.Login(conn.User(), remoteHost(conn.RemoteAddr().String()))
+		if ok {
+			buf.WriteString("Last login: ")
+			buf.WriteString(last.Time.Format("Mon Jan _2 15:04:05 2006"))
+			if last.From != "" {
+				buf.WriteString(" from ")
+				buf.WriteString(last.From)
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// LastLogin is the last login of a user
+type LastLogin struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from,omitempty"`
+}
+
+// LastLog records the last login of each user, in memory or persisted in a JSON file
+type LastLog struct {
+	// Path is the file the logins are persisted to
+	// If empty, then the logins are only kept in memory
+	Path string
+	// Logger error log
+	Logger Logger
+
+	mut    sync.Mutex
+	logins map[string]LastLogin
+}
+
+// Login records the login of the user and returns the previous one
+func (l *LastLog) Login(user, from string) (LastLogin, bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.logins == nil {
+		l.logins = map[string]LastLogin{}
+		if l.Path != "" {
+			err := l.load()
+			if err != nil && l.Logger != nil {
+				l.Logger.Println("unable to load lastlog:", err)
+			}
+		}
+	}
+	last, ok := l.logins[user]
+	l.logins[user] = LastLogin{
+		Time: time.Now(),
+		From: from,
+	}
+	if l.Path != "" {
+		err := l.save()
+		if err != nil && l.Logger != nil {
+			l.Logger.Println("unable to save lastlog:", err)
+		}
+	}
+	return last, ok
+}
+
+func (l *LastLog) load() error {
+	data, err := os.ReadFile(l.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &l.logins)
+}
+
+// save writes the logins atomically, so the file is never partially written
+func (l *LastLog) save() error {
+	data, err := json.Marshal(l.logins)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.Path, data, 0o600)
+}
@@ -0,0 +1,171 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertAuthority authenticates OpenSSH user certificates signed by trusted CAs
+type CertAuthority struct {
+	// TrustedUserCAKeys are the keys trusted to sign user certificates
+	TrustedUserCAKeys []ssh.PublicKey
+	// AuthorizedPrincipals returns the principals accepted for the user
+	// If nil, then the certificate must list the user name as a principal
+	AuthorizedPrincipals func(user string) []string
+	// ClockSkew is the tolerance applied to the validity window of certificates
+	ClockSkew time.Duration
+	// UserKeyFallback authenticates keys that are not certificates
+	// If nil, then such keys are rejected
+	UserKeyFallback func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+}
+
+// PublicKeyCallback authenticates the certificate and returns the permissions granted by
+// its critical options and extensions, it can be used as ssh.ServerConfig.PublicKeyCallback
+func (c *CertAuthority) PublicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		if c.UserKeyFallback != nil {
+			return c.UserKeyFallback(conn, key)
+		}
+		return nil, fmt.Errorf("unauthorized key %s", ssh.FingerprintSHA256(key))
+	}
+	return c.Authenticate(conn, cert)
+}
+
+// Authenticate checks the certificate for the connection
+func (c *CertAuthority) Authenticate(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate %q is not a user certificate", cert.KeyId)
+	}
+
+	now := time.Now()
+	if after := int64(cert.ValidAfter); after < 0 || now.Add(c.ClockSkew).Unix() < after {
+		return nil, fmt.Errorf("certificate %q is not yet valid", cert.KeyId)
+	}
+	if before := cert.ValidBefore; before != ssh.CertTimeInfinity && (before > 1<<63-1 || now.Add(-c.ClockSkew).Unix() >= int64(before)) {
+		return nil, fmt.Errorf("certificate %q has expired", cert.KeyId)
+	}
+
+	// The validity window is checked above with the skew, so the
+	// checker is given a time inside the window.
+	checkTime := now
+	if t := time.Unix(int64(cert.ValidAfter), 0); checkTime.Before(t) {
+		checkTime = t
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		if t := time.Unix(int64(cert.ValidBefore)-1, 0); checkTime.After(t) {
+			checkTime = t
+		}
+	}
+	checker := &ssh.CertChecker{
+		SupportedCriticalOptions: []string{OptionForceCommand, OptionSourceAddress},
+		IsUserAuthority:          c.isUserAuthority,
+		Clock: func() time.Time {
+			return checkTime
+		},
+	}
+
+	principals := []string{conn.User()}
+	if c.AuthorizedPrincipals != nil {
+		principals = c.AuthorizedPrincipals(conn.User())
+	}
+	var err error = fmt.Errorf("certificate %q has no authorized principal for %q", cert.KeyId, conn.User())
+	for _, principal := range principals {
+		if err = checker.CheckCert(principal, cert); err == nil {
+			return CertPermissions(cert), nil
+		}
+	}
+	return nil, err
+}
+
+func (c *CertAuthority) isUserAuthority(auth ssh.PublicKey) bool {
+	data := auth.Marshal()
+	for _, ca := range c.TrustedUserCAKeys {
+		if bytes.Equal(ca.Marshal(), data) {
+			return true
+		}
+	}
+	return false
+}
+
+// CertPermissions returns the critical options and extensions of the certificate
+// as ssh.Permissions to be enforced after authentication
+func CertPermissions(cert *ssh.Certificate) *ssh.Permissions {
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions: map[string]string{
+			ExtensionRestricted: "",
+		},
+	}
+	for k, v := range cert.CriticalOptions {
+		perms.CriticalOptions[k] = v
+	}
+	for k, v := range cert.Extensions {
+		// The extensions of this server are set by the server alone,
+		// a certificate could otherwise claim another key or lift restrictions
+		if strings.HasSuffix(k, "@sshd") {
+			continue
+		}
+		perms.Extensions[k] = v
+	}
+	return perms
+}
+
+// mergePermissions restricts the permissions of a certificate by the options of the CA key
+func mergePermissions(cert *ssh.Permissions, opts *KeyOptions) (*ssh.Permissions, error) {
+	keyPerms := opts.Permissions()
+	if cmd, ok := keyPerms.CriticalOptions[OptionForceCommand]; ok {
+		if certCmd, ok := cert.CriticalOptions[OptionForceCommand]; ok && certCmd != cmd {
+			return nil, fmt.Errorf("certificate and key options force different commands")
+		}
+		cert.CriticalOptions[OptionForceCommand] = cmd
+	}
+	for k, v := range keyPerms.Extensions {
+		if !strings.HasPrefix(k, "permit-") {
+			cert.Extensions[k] = v
+		}
+	}
+	for k := range cert.Extensions {
+		if _, ok := keyPerms.Extensions[k]; !ok && strings.HasPrefix(k, "permit-") {
+			delete(cert.Extensions, k)
+		}
+	}
+	return cert, nil
+}
+
+// GetPublicKeysFile reads the public keys of a file in authorized_keys format
+func GetPublicKeysFile(file string) ([]ssh.PublicKey, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParsePublicKeys(f)
+}
+
+// ParsePublicKeys parses public keys in authorized_keys format, ignoring options
+func ParsePublicKeys(r io.Reader) ([]ssh.PublicKey, error) {
+	keys := []ssh.PublicKey{}
+	read := bufio.NewReader(r)
+	for {
+		line, _, err := read.ReadLine()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if key, _, _, _, err := ssh.ParseAuthorizedKey(line); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,39 @@
+package sshd
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertPermissions(t *testing.T) {
+	cert := &ssh.Certificate{
+		CertType: ssh.UserCert,
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{OptionForceCommand: "true"},
+			Extensions: map[string]string{
+				ExtensionPermitPty:    "",
+				ExtensionRestricted:   "",
+				"publickey@sshd":      "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEvkwUjmVKW5JsV4FVNFtnU7HmETcl1HLdZTqb1thAt/",
+				ExtensionEnvironment:  "LD_PRELOAD=/tmp/x.so",
+				ExtensionPermitOpen:   "*:*",
+				ExtensionPermitListen: "*:*",
+			},
+		},
+	}
+	perms := CertPermissions(cert)
+	if cmd, _ := ForceCommand(perms); cmd != "true" {
+		t.Errorf("ForceCommand() = %q, want %q", cmd, "true")
+	}
+	if _, ok := perms.Extensions[ExtensionPermitPty]; !ok {
+		t.Errorf("%s is dropped", ExtensionPermitPty)
+	}
+	if _, ok := perms.Extensions[ExtensionRestricted]; !ok {
+		t.Errorf("%s is not set", ExtensionRestricted)
+	}
+	for _, k := range []string{"publickey@sshd", ExtensionEnvironment, ExtensionPermitOpen, ExtensionPermitListen} {
+		if _, ok := perms.Extensions[k]; ok {
+			t.Errorf("%s of the certificate is kept", k)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package sshd
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Channel is an open channel tracked by its connection
+type Channel struct {
+	ssh.Channel
+	// ID is unique within the connection
+	ID string
+	// Type is the channel type
+	Type string
+	// Target is the destination of the channel, e.g. host:port or socket path
+	Target string
+	// Started is the time the channel was opened
+	Started time.Time
+
+	bytesIn    int64
+	bytesOut   int64
+	closed     int32
+	serverConn *ServerConn
+}
+
+// ChannelInfo describes an open channel
+type ChannelInfo struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Target   string    `json:"target,omitempty"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Started  time.Time `json:"started"`
+}
+
+// Info returns a snapshot of the channel
+func (c *Channel) Info() ChannelInfo {
+	return ChannelInfo{
+		ID:       c.ID,
+		Type:     c.Type,
+		Target:   c.Target,
+		BytesIn:  atomic.LoadInt64(&c.bytesIn),
+		BytesOut: atomic.LoadInt64(&c.bytesOut),
+		Started:  c.Started,
+	}
+}
+
+// Read counts the bytes received from the client
+func (c *Channel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	return n, err
+}
+
+// Write counts the bytes sent to the client
+func (c *Channel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	return n, err
+}
+
+// Close closes the channel and stops tracking it
+func (c *Channel) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.serverConn.untrackChannel(c)
+	}
+	return c.Channel.Close()
+}
+
+// trackChannel starts tracking the channel until it is closed
+func (s *ServerConn) trackChannel(chType string, extraData []byte, ch ssh.Channel) *Channel {
+	c := &Channel{
+		Channel:    ch,
+		ID:         strconv.FormatUint(atomic.AddUint64(&s.lastChannelID, 1), 10),
+		Type:       chType,
+		Target:     channelTarget(chType, extraData),
+		Started:    time.Now(),
+		serverConn: s,
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.channels == nil {
+		s.channels = map[string]*Channel{}
+	}
+	s.channels[c.ID] = c
+	return c
+}
+
+func (s *ServerConn) untrackChannel(c *Channel) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.channels, c.ID)
+}
+
+// channelTarget returns the destination described by the extra data of the channel
+func channelTarget(chType string, extraData []byte) string {
+	switch chType {
+	case "direct-tcpip":
+		var msg ChannelOpenDirectMsg
+		if ssh.Unmarshal(extraData, &msg) == nil {
+			return fmt.Sprintf("%s:%d", msg.RAddr, msg.RPort)
+		}
+	case "forwarded-tcpip":
+		var msg ForwardedTCPPayload
+		if ssh.Unmarshal(extraData, &msg) == nil {
+			return fmt.Sprintf("%s:%d", msg.OriginAddr, msg.OriginPort)
+		}
+	case "direct-streamlocal@openssh.com":
+		var msg StreamLocalChannelOpenDirectMsg
+		if ssh.Unmarshal(extraData, &msg) == nil {
+			return msg.SocketPath
+		}
+	case "forwarded-streamlocal@openssh.com":
+		var msg ForwardedStreamLocalPayload
+		if ssh.Unmarshal(extraData, &msg) == nil {
+			return msg.SocketPath
+		}
+	}
+	return ""
+}
+
+// trackNewChannel tracks the channel once it is accepted
+type trackNewChannel struct {
+	ssh.NewChannel
+	serverConn *ServerConn
+}
+
+func (n *trackNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := n.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	return n.serverConn.trackChannel(n.ChannelType(), n.ExtraData(), ch), reqs, nil
+}
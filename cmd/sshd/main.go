@@ -1,18 +1,37 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	_ "github.com/wzshiming/sshd/directstreamlocal"
 	_ "github.com/wzshiming/sshd/directtcp"
+	_ "github.com/wzshiming/sshd/hostkeys"
 	_ "github.com/wzshiming/sshd/session"
 	_ "github.com/wzshiming/sshd/streamlocalforward"
 	_ "github.com/wzshiming/sshd/tcpforward"
 
+	"github.com/google/shlex"
 	"github.com/wzshiming/sshd"
+	"github.com/wzshiming/sshd/admin"
+	"github.com/wzshiming/sshd/audit"
+	"github.com/wzshiming/sshd/guard"
+	"github.com/wzshiming/sshd/passwd"
+	"github.com/wzshiming/sshd/policy"
+	"github.com/wzshiming/sshd/reload"
+	"github.com/wzshiming/sshd/totp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -20,14 +39,78 @@ var address string
 var username string
 var password string
 var authorized string
-var hostkey string
+var passwords string
+var hostkeys stringsFlag
+var hostkeyDir string
+var hostCerts stringsFlag
+var hostkeyAgent string
+var hostPrincipals string
+var hostCertWarn time.Duration
+var metricsAddress string
+var adminAddress string
+var maxConnections int
+var maxConnectionsPerIP int
+var maxStartups string
+var handshakeTimeout time.Duration
+var maxAuthFailures int
+var trustedUserCAKeys string
+var revokedKeys string
+var totpSecrets string
+var authMethods string
+var keysCommand string
+var keysURL string
+var principalsCommand string
+var principalsURL string
+var userKeys string
+var watch bool
+var bannerFile string
+var motdFile string
+var lastLogFile string
+var strictModes bool
+var banTime time.Duration
+var policyFile string
+var auditFile string
+var auditKey string
+var auditSyslog bool
 
 func init() {
 	flag.StringVar(&address, "a", ":22", "listen on the address")
 	flag.StringVar(&username, "u", "", "username")
 	flag.StringVar(&password, "p", "", "password")
 	flag.StringVar(&authorized, "f", "", "authorized file")
-	flag.StringVar(&hostkey, "h", "", "hostkey file")
+	flag.StringVar(&passwords, "passwd", "", "password file of user:hash lines, hashed with bcrypt, argon2id or sha512-crypt")
+	flag.Var(&hostkeys, "h", "hostkey file, may be repeated")
+	flag.StringVar(&hostkeyAgent, "hostkey-agent", "", "unix socket of an ssh-agent holding the host keys, which sign without leaving it")
+	flag.Var(&hostCerts, "host-cert", "host certificate file of one of the host keys, may be repeated")
+	flag.StringVar(&hostPrincipals, "host-principals", "", "comma separated principals the host certificates must be valid for")
+	flag.DurationVar(&hostCertWarn, "host-cert-warn", 7*24*time.Hour, "warn when a host certificate expires within this duration")
+	flag.StringVar(&hostkeyDir, "hostkey-dir", defaultHostkeyDir(), "directory of the ed25519, ecdsa and rsa host keys generated on first start, used when no -h or -hostkey-agent is given, if empty a temporary key is used")
+	flag.BoolVar(&watch, "watch", false, "reload the host key, authorized keys, password, banner and policy files when they change, they are also reloaded on SIGHUP")
+	flag.StringVar(&bannerFile, "banner", "", "banner file shown before authentication, a text/template with .User, .RemoteAddr, .LocalAddr, .ClientVersion and .Time")
+	flag.StringVar(&motdFile, "motd", "", "message of the day file shown to interactive sessions")
+	flag.StringVar(&lastLogFile, "lastlog", "", "file recording the last logins shown to interactive sessions")
+	flag.StringVar(&metricsAddress, "metrics", "", "serve prometheus metrics on the address")
+	flag.StringVar(&adminAddress, "admin", "", "serve the admin api on the loopback address or unix:/path/to/socket")
+	flag.IntVar(&maxConnections, "max-conns", 0, "maximum number of concurrent connections, 0 is unlimited")
+	flag.IntVar(&maxConnectionsPerIP, "max-conns-per-ip", 0, "maximum number of concurrent connections from a single IP, 0 is unlimited")
+	flag.StringVar(&maxStartups, "max-startups", "", "drop unauthenticated connections randomly, start:rate:full")
+	flag.DurationVar(&handshakeTimeout, "handshake-timeout", 2*time.Minute, "close connections not authenticated in time, 0 is no timeout")
+	flag.IntVar(&maxAuthFailures, "max-auth-failures", 10, "ban an IP after this many authentication failures within 10 minutes, 0 disables banning")
+	flag.DurationVar(&banTime, "ban-time", time.Hour, "how long an IP is banned")
+	flag.StringVar(&keysCommand, "keys-command", "", "command printing the authorized keys of a user, run with the user, key type and fingerprint")
+	flag.StringVar(&keysURL, "keys-url", "", "url returning the authorized keys of a user, queried with the user, type and fingerprint")
+	flag.StringVar(&userKeys, "user-keys", "", "authorized keys file of each user, %h is the home directory and %u the username, like %h/.ssh/authorized_keys")
+	flag.BoolVar(&strictModes, "strict-modes", true, "refuse user keys files writable by others or owned by another user")
+	flag.StringVar(&principalsCommand, "principals-command", "", "command printing the principals of a user accepted for certificates, run with the user")
+	flag.StringVar(&principalsURL, "principals-url", "", "url returning the principals of a user accepted for certificates, queried with the user")
+	flag.StringVar(&trustedUserCAKeys, "ca", "", "trusted user CA keys file, certificates signed by them are accepted for the principals listed")
+	flag.StringVar(&totpSecrets, "totp", "", "TOTP secrets file of user:base32-secret lines, a verification code is required after the public key")
+	flag.StringVar(&authMethods, "auth-methods", "", "required authentication methods like \"publickey,password publickey,keyboard-interactive\"")
+	flag.StringVar(&revokedKeys, "revoked-keys", "", "KRL or revoked public keys file, reloaded on change")
+	flag.StringVar(&auditFile, "audit", "", "append the authentication attempts and authorization decisions to the file as hash chained JSON lines, reopened on SIGHUP")
+	flag.StringVar(&auditKey, "audit-key", "", "file of the key the -audit chain is keyed with, kept out of reach of those who can write the audit file")
+	flag.BoolVar(&auditSyslog, "audit-syslog", false, "send the authentication attempts and authorization decisions to syslog")
+	flag.StringVar(&policyFile, "policy", "", "JSON policy file of rules allowing or denying channels and requests, the first matching rule applies")
 	flag.Parse()
 }
 
@@ -35,13 +118,88 @@ func main() {
 	logger := log.New(os.Stderr, "[sshd] ", log.LstdFlags)
 	svc := sshd.NewServer()
 	svc.Logger = logger
-	if hostkey != "" {
-		key, err := sshd.GetHostkey(hostkey)
+	svc.MaxConnections = maxConnections
+	svc.MaxConnectionsPerIP = maxConnectionsPerIP
+	svc.HandshakeTimeout = handshakeTimeout
+	svc.ServerConfig.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		if err != nil && method != "none" {
+			logger.Println("authentication failed:", method, "for", conn.User(), "from", conn.RemoteAddr(), err)
+		}
+	}
+	var bans *guard.Guard
+	if maxAuthFailures > 0 {
+		bans = guard.NewGuard()
+		bans.MaxFailures = maxAuthFailures
+		bans.BanTime = banTime
+		bans.Logger = logger
+		svc.Guard = bans
+	}
+	if maxStartups != "" {
+		m, err := sshd.ParseMaxStartups(maxStartups)
 		if err != nil {
 			logger.Println(err)
 			return
 		}
-		svc.ServerConfig.AddHostKey(key)
+		svc.MaxStartups = m
+	}
+	reloads := &reload.Group{
+		Logger: logger,
+	}
+	var watchFiles []string
+	if len(hostkeys) != 0 || hostkeyAgent != "" || hostkeyDir != "" {
+		reloadHostkeys := func() error {
+			var keys []ssh.Signer
+			for _, hostkey := range hostkeys {
+				key, err := sshd.GetHostkey(hostkey)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, key)
+			}
+			if hostkeyAgent != "" {
+				k, err := sshd.GetAgentHostkeys(hostkeyAgent)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, k...)
+			}
+			if len(keys) == 0 {
+				k, err := sshd.GetHostKeysDir(hostkeyDir)
+				if err != nil {
+					return err
+				}
+				keys = k
+			}
+			var principals []string
+			if hostPrincipals != "" {
+				principals = strings.Split(hostPrincipals, ",")
+			}
+			for _, hostCert := range hostCerts {
+				cert, err := getHostCertificate(hostCert, keys, principals)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, cert)
+			}
+			svc.SetHostKeys(keys...)
+			warnHostCertExpiry(logger, keys)
+			return nil
+		}
+		err := reloadHostkeys()
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		reloads.Add("host keys", reloadHostkeys)
+		watchFiles = append(watchFiles, hostkeys...)
+		watchFiles = append(watchFiles, hostCerts...)
+		if len(hostCerts) != 0 {
+			go func() {
+				for range time.Tick(time.Hour) {
+					warnHostCertExpiry(logger, svc.HostKeys())
+				}
+			}()
+		}
 	} else {
 		key, err := sshd.RandomHostkey()
 		if err != nil {
@@ -50,33 +208,325 @@ func main() {
 		}
 		svc.ServerConfig.AddHostKey(key)
 	}
-	if username != "" {
+	if bannerFile != "" {
+		var banner atomic.Pointer[sshd.Banner]
+		reloadBanner := func() error {
+			b, err := sshd.GetBannerFile(bannerFile)
+			if err != nil {
+				return err
+			}
+			banner.Store(b)
+			return nil
+		}
+		err := reloadBanner()
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		svc.ServerConfig.BannerCallback = func(conn ssh.ConnMetadata) string {
+			return banner.Load().BannerCallback(conn)
+		}
+		reloads.Add("banner", reloadBanner)
+		watchFiles = append(watchFiles, bannerFile)
+	}
+	if motdFile != "" || lastLogFile != "" {
+		motd := &sshd.Motd{
+			Path: motdFile,
+		}
+		if lastLogFile != "" {
+			motd.LastLog = &sshd.LastLog{
+				Path:   lastLogFile,
+				Logger: logger,
+			}
+		}
+		svc.Motd = motd.Message
+	}
+	if passwords != "" {
+		p, err := passwd.NewFile(passwords)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		svc.ServerConfig.PasswordCallback = p.PasswordCallback
+		reloads.Add("passwords", p.Reload)
+		watchFiles = append(watchFiles, passwords)
+	} else if username != "" {
 		svc.ServerConfig.PasswordCallback = func(conn ssh.ConnMetadata, pwd []byte) (*ssh.Permissions, error) {
-			if conn.User() == username && password == string(pwd) {
+			userOK := subtle.ConstantTimeCompare([]byte(conn.User()), []byte(username))
+			passwordOK := subtle.ConstantTimeCompare(pwd, []byte(password))
+			if userOK&passwordOK == 1 {
 				return nil, nil
 			}
 			return nil, fmt.Errorf("denied")
 		}
 	}
+	var keyCallbacks []func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
 	if authorized != "" {
-		keys, err := sshd.GetAuthorizedFile(authorized)
+		keys, err := sshd.NewAuthorizedFile(authorized)
 		if err != nil {
 			logger.Println(err)
 			return
 		}
-		svc.ServerConfig.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			ok, _ := keys.Allow(key)
-			if ok {
-				return nil, nil
+		keyCallbacks = append(keyCallbacks, keys.PublicKeyCallback)
+		reloads.Add("authorized keys", keys.Reload)
+		watchFiles = append(watchFiles, authorized)
+	}
+	if keysCommand != "" || keysURL != "" {
+		lookup, err := newLookup(keysCommand, keysURL, logger)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		authorizedLookup := &sshd.AuthorizedLookup{
+			Lookup: lookup,
+		}
+		keyCallbacks = append(keyCallbacks, authorizedLookup.PublicKeyCallback)
+	}
+	if userKeys != "" {
+		userAuthorized := &sshd.UserAuthorized{
+			Path:        userKeys,
+			StrictModes: strictModes,
+			Logger:      logger,
+		}
+		keyCallbacks = append(keyCallbacks, userAuthorized.PublicKeyCallback)
+	}
+	if len(keyCallbacks) != 0 {
+		svc.ServerConfig.PublicKeyCallback = firstPublicKeyCallback(keyCallbacks)
+	}
+	if trustedUserCAKeys != "" {
+		cas, err := sshd.GetPublicKeysFile(trustedUserCAKeys)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		ca := &sshd.CertAuthority{
+			TrustedUserCAKeys: cas,
+			ClockSkew:         time.Minute,
+			UserKeyFallback:   svc.ServerConfig.PublicKeyCallback,
+		}
+		if principalsCommand != "" || principalsURL != "" {
+			lookup, err := newLookup(principalsCommand, principalsURL, logger)
+			if err != nil {
+				logger.Println(err)
+				return
 			}
-			return nil, fmt.Errorf("denied")
+			ca.AuthorizedPrincipals = lookup.Principals
+		}
+		svc.ServerConfig.PublicKeyCallback = ca.PublicKeyCallback
+	}
+	var methods [][]string
+	if authMethods != "" {
+		var err error
+		methods, err = sshd.ParseAuthenticationMethods(authMethods)
+		if err != nil {
+			logger.Println(err)
+			return
 		}
 	}
-	if username == "" && authorized == "" {
+	if totpSecrets != "" {
+		if svc.ServerConfig.PublicKeyCallback == nil && (methods == nil || svc.ServerConfig.PasswordCallback == nil) {
+			logger.Println("-totp requires public key authentication, or password authentication with -auth-methods")
+			return
+		}
+		// The code is a second factor, no method list may accept it alone
+		for _, list := range methods {
+			if !slices.Contains(list, "publickey") && !slices.Contains(list, "password") {
+				logger.Printf("-totp requires publickey or password in each -auth-methods list, not %q", strings.Join(list, ","))
+				return
+			}
+		}
+		secrets, err := totp.GetSecretsFile(totpSecrets)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		auth := &totp.Authenticator{
+			Secrets: secrets,
+			Skew:    1,
+			Logger:  logger,
+		}
+		if methods != nil {
+			svc.ServerConfig.KeyboardInteractiveCallback = auth.KeyboardInteractiveCallback
+		} else {
+			svc.ServerConfig.PublicKeyCallback = auth.PublicKeyCallback(svc.ServerConfig.PublicKeyCallback)
+		}
+	}
+	// Without any way to authenticate, everyone is let in
+	if svc.ServerConfig.PasswordCallback == nil && svc.ServerConfig.PublicKeyCallback == nil && svc.ServerConfig.KeyboardInteractiveCallback == nil {
 		svc.ServerConfig.NoClientAuth = true
 	}
+	if methods != nil {
+		required := &sshd.AuthenticationMethods{
+			Default: methods,
+		}
+		required.Apply(&svc.ServerConfig)
+	}
+	if revokedKeys != "" {
+		revoked, err := sshd.NewRevokedKeysFile(revokedKeys)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		revoked.Logger = logger
+		svc.RevocationList = revoked
+		reloads.Add("revoked keys", revoked.Reload)
+	}
+	if policyFile != "" {
+		p, err := policy.NewFile(policyFile)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		svc.ConnPermissions = p.Permissions
+		reloads.Add("policy", p.Reload)
+		watchFiles = append(watchFiles, policyFile)
+	}
+	if auditFile != "" {
+		if auditKey == "" {
+			logger.Println("-audit requires -audit-key")
+			return
+		}
+		key, err := os.ReadFile(auditKey)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		f, err := audit.NewFile(auditFile, bytes.TrimSpace(key))
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		svc.Audit = sshd.JoinAuditSinks(svc.Audit, f)
+		// The head is logged to detect lines cut from the end of the file
+		logger.Println("audit log head:", f.Head())
+		reloads.Add("audit log", func() error {
+			logger.Println("audit log head:", f.Head())
+			return f.Reopen()
+		})
+	}
+	if auditSyslog {
+		s, err := audit.NewSyslog("sshd")
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		svc.Audit = sshd.JoinAuditSinks(svc.Audit, s)
+	}
+	if metricsAddress != "" {
+		svc.Metrics = sshd.NewMetrics()
+		go func() {
+			err := http.ListenAndServe(metricsAddress, svc.Metrics)
+			if err != nil {
+				logger.Println(err)
+			}
+		}()
+	}
+	if adminAddress != "" {
+		listener, err := admin.Listen(adminAddress)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		handler := admin.NewHandler(svc)
+		handler.Logger = logger
+		handler.Reload = reloads.Reload
+		handler.Guard = bans
+		go func() {
+			err := http.Serve(listener, handler)
+			if err != nil {
+				logger.Println(err)
+			}
+		}()
+	}
+	go reloads.NotifySignal(context.Background(), syscall.SIGHUP)
+	if watch && len(watchFiles) != 0 {
+		go reloads.Watch(context.Background(), watchFiles...)
+	}
 	err := svc.ListenAndServe("tcp", address)
 	if err != nil {
 		logger.Println(err)
 	}
 }
+
+func newLookup(command, url string, logger sshd.Logger) (*sshd.Lookup, error) {
+	lookup := &sshd.Lookup{
+		URL:      url,
+		CacheTTL: time.Minute,
+		Logger:   logger,
+	}
+	if command != "" {
+		args, err := shlex.Split(command)
+		if err != nil {
+			return nil, err
+		}
+		lookup.Command = args
+	}
+	return lookup, nil
+}
+
+// firstPublicKeyCallback returns a callback accepting the keys accepted by any of the callbacks,
+// returning the permissions of the first one
+func firstPublicKeyCallback(callbacks []func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if len(callbacks) == 1 {
+		return callbacks[0]
+	}
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		var err error
+		for _, callback := range callbacks {
+			var perms *ssh.Permissions
+			perms, err = callback(conn, key)
+			if err == nil {
+				return perms, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// stringsFlag is a flag that may be repeated
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// defaultHostkeyDir returns the directory of the host keys in the user config directory
+func defaultHostkeyDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sshd")
+}
+
+// getHostCertificate reads the host certificate and pairs it with the host key it certifies
+func getHostCertificate(file string, keys []ssh.Signer, principals []string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := sshd.ParseHostCertificateKeys(data, keys, principals)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return signer, nil
+}
+
+// warnHostCertExpiry logs the host certificates expiring within hostCertWarn
+func warnHostCertExpiry(logger *log.Logger, keys []ssh.Signer) {
+	for _, key := range keys {
+		expiry, ok := sshd.CertificateExpiry(key)
+		if !ok {
+			continue
+		}
+		if left := time.Until(expiry); left < hostCertWarn {
+			cert := key.PublicKey().(*ssh.Certificate)
+			logger.Printf("warning: host certificate %q expires at %s, in %s", cert.KeyId, expiry.Format(time.RFC3339), left.Round(time.Minute))
+		}
+	}
+}
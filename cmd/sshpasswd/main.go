@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wzshiming/sshd/passwd"
+	"golang.org/x/term"
+)
+
+var scheme string
+
+func init() {
+	flag.StringVar(&scheme, "s", string(passwd.Bcrypt), "hash scheme, bcrypt, argon2id or sha512-crypt")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-s scheme] user\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Reads the password from the terminal or stdin and prints a user:hash line")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+func main() {
+	if flag.NArg() != 1 || strings.Contains(flag.Arg(0), ":") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	password, err := readPassword()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	hash, err := passwd.Hash(passwd.Scheme(scheme), password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s:%s\n", flag.Arg(0), hash)
+}
+
+func readPassword() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(os.Stderr, "Retype password: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(password, again) {
+		return nil, fmt.Errorf("passwords do not match")
+	}
+	return password, nil
+}
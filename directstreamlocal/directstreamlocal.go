@@ -21,11 +21,8 @@ func (s *DirectStreamLocal) Handle(ctx context.Context, newChan ssh.NewChannel,
 		return
 	}
 
-	if serverConn.Permissions != nil && !serverConn.Permissions.Allow(name, msg.SocketPath) {
-		if serverConn.Logger != nil {
-			serverConn.Logger.Println("prohibited:", name, msg.SocketPath)
-		}
-		newChan.Reject(ssh.Prohibited, "Error administratively prohibited")
+	if decision := serverConn.Authorize(ctx, &sshd.AuthorizeRequest{Type: name, Args: msg.SocketPath, Msg: &msg}); !decision.Allow {
+		newChan.Reject(ssh.Prohibited, decision.Reason)
 		return
 	}
 
@@ -48,21 +45,8 @@ func (s *DirectStreamLocal) Handle(ctx context.Context, newChan ssh.NewChannel,
 	}
 	defer ch.Close()
 
-	var buf1, buf2 []byte
-	if serverConn.BytesPool != nil {
-		buf1 = serverConn.BytesPool.Get()
-		buf2 = serverConn.BytesPool.Get()
-		defer func() {
-			serverConn.BytesPool.Put(buf1)
-			serverConn.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
-	}
-
 	go sshd.DiscardRequests(serverConn.Logger, reqs)
-	err = sshd.Tunnel(ctx, ch, outbound, buf1, buf2)
+	err = serverConn.Tunnel(ctx, name, ch, outbound)
 	if err != nil && !sshd.IsClosedConnError(err) {
 		if serverConn.Logger != nil {
 			serverConn.Logger.Println("Tunnel:", err)
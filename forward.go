@@ -0,0 +1,127 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Forward is a remote forward listener tracked by its connection
+type Forward struct {
+	// ID is unique within the connection
+	ID string
+	// Type is the global request type that created the listener
+	Type string
+	// Addr is the address the listener is bound to, as requested with the port allocated,
+	// or the socket path
+	Addr string
+	// Started is the time the listener was created
+	Started time.Time
+
+	listener io.Closer
+}
+
+// ForwardInfo describes a remote forward listener
+type ForwardInfo struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Addr    string    `json:"addr"`
+	Started time.Time `json:"started"`
+}
+
+// Info returns a snapshot of the forward
+func (f *Forward) Info() ForwardInfo {
+	return ForwardInfo{
+		ID:      f.ID,
+		Type:    f.Type,
+		Addr:    f.Addr,
+		Started: f.Started,
+	}
+}
+
+// Close closes the listener of the forward
+func (f *Forward) Close() error {
+	return f.listener.Close()
+}
+
+// TrackForward starts tracking the listener of a remote forward until UntrackForward,
+// once the forwards of the connection are closed the listener is closed and an error returned
+func (s *ServerConn) TrackForward(typ, addr string, listener io.Closer) (*Forward, error) {
+	f := &Forward{
+		ID:       strconv.FormatUint(atomic.AddUint64(&s.lastForwardID, 1), 10),
+		Type:     typ,
+		Addr:     addr,
+		Started:  time.Now(),
+		listener: listener,
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.forwardsClosed {
+		listener.Close()
+		return nil, fmt.Errorf("connection is closing")
+	}
+	if s.forwards == nil {
+		s.forwards = map[string]*Forward{}
+	}
+	s.forwards[f.ID] = f
+	return f, nil
+}
+
+// UntrackForward stops tracking the forward
+func (s *ServerConn) UntrackForward(f *Forward) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.forwards, f.ID)
+}
+
+// Forwards returns the remote forwards ordered by the time they were created
+func (s *ServerConn) Forwards() []*Forward {
+	s.mut.Lock()
+	forwards := make([]*Forward, 0, len(s.forwards))
+	for _, f := range s.forwards {
+		forwards = append(forwards, f)
+	}
+	s.mut.Unlock()
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].Started.Before(forwards[j].Started)
+	})
+	return forwards
+}
+
+// LookupForward returns the remote forward of the type bound to the address
+func (s *ServerConn) LookupForward(typ, addr string) (*Forward, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, f := range s.forwards {
+		if f.Type == typ && f.Addr == addr {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// closeForwards closes all the remote forwards, and those tracked afterwards
+func (s *ServerConn) closeForwards() {
+	s.mut.Lock()
+	forwards := s.forwards
+	s.forwards = nil
+	s.forwardsClosed = true
+	s.mut.Unlock()
+	for _, f := range forwards {
+		f.Close()
+	}
+}
+
+// CloseForward closes the remote forward with the id
+func (s *ServerConn) CloseForward(id string) error {
+	s.mut.Lock()
+	f, ok := s.forwards[id]
+	s.mut.Unlock()
+	if !ok {
+		return fmt.Errorf("forward %q not found", id)
+	}
+	return f.Close()
+}
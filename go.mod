@@ -5,6 +5,6 @@ go 1.23.0
 require (
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
 	golang.org/x/crypto v0.35.0
+	golang.org/x/sys v0.30.0
+	golang.org/x/term v0.29.0
 )
-
-require golang.org/x/sys v0.30.0 // indirect
@@ -0,0 +1,18 @@
+package sshd
+
+import (
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Guard protects the server against brute-force authentication
+type Guard interface {
+	// AllowConn reports whether a new connection from the address is accepted
+	AllowConn(addr net.Addr) bool
+	// AuthFailed is called after a failed authentication attempt,
+	// it may block to delay the response to the client
+	AuthFailed(conn ssh.ConnMetadata, method string, err error)
+	// AuthSucceeded is called after a successful authentication
+	AuthSucceeded(conn ssh.ConnMetadata, method string)
+}
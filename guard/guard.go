@@ -0,0 +1,307 @@
+package guard
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// Guard tracks failed authentication attempts per source IP and per username
+// over a sliding window, delays the responses to repeated failures exponentially
+// and bans source IPs that exceed the limit
+type Guard struct {
+	// Window is the sliding window over which failures are counted
+	// If zero, then 10 minutes
+	Window time.Duration
+	// MaxFailures is the number of failures from a single IP within the window after which it is banned
+	// If zero, then 10
+	MaxFailures int
+	// BanTime is how long an IP is banned
+	// If zero, then 1 hour
+	BanTime time.Duration
+	// BaseDelay is the delay after the first failure, doubled by each further failure
+	// of the same IP or username within the window
+	// If zero, then 250 milliseconds
+	BaseDelay time.Duration
+	// MaxDelay caps the delay after a failure
+	// If zero, then 10 seconds
+	MaxDelay time.Duration
+	// Methods are the authentication methods whose failures are counted
+	// If nil, then password and keyboard-interactive
+	Methods []string
+	// Logger error log
+	Logger sshd.Logger
+
+	mut       sync.Mutex
+	ips       map[string][]time.Time
+	users     map[string][]time.Time
+	bans      map[string]Ban
+	lastPrune time.Time
+}
+
+var _ sshd.Guard = (*Guard)(nil)
+
+// Ban is a banned source IP
+type Ban struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+}
+
+// NewGuard returns a Guard with the default settings
+func NewGuard() *Guard {
+	return &Guard{}
+}
+
+func (g *Guard) window() time.Duration {
+	if g.Window <= 0 {
+		return 10 * time.Minute
+	}
+	return g.Window
+}
+
+func (g *Guard) maxFailures() int {
+	if g.MaxFailures <= 0 {
+		return 10
+	}
+	return g.MaxFailures
+}
+
+func (g *Guard) banTime() time.Duration {
+	if g.BanTime <= 0 {
+		return time.Hour
+	}
+	return g.BanTime
+}
+
+func (g *Guard) baseDelay() time.Duration {
+	if g.BaseDelay <= 0 {
+		return 250 * time.Millisecond
+	}
+	return g.BaseDelay
+}
+
+func (g *Guard) maxDelay() time.Duration {
+	if g.MaxDelay <= 0 {
+		return 10 * time.Second
+	}
+	return g.MaxDelay
+}
+
+func (g *Guard) counted(method string) bool {
+	methods := g.Methods
+	if methods == nil {
+		methods = []string{"password", "keyboard-interactive"}
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowConn reports whether the source IP of the address is not banned
+func (g *Guard) AllowConn(addr net.Addr) bool {
+	ip := addrIP(addr)
+	now := time.Now()
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	ban, ok := g.bans[ip]
+	if !ok {
+		return true
+	}
+	if now.Before(ban.Until) {
+		return false
+	}
+	delete(g.bans, ip)
+	return true
+}
+
+// AuthFailed records the failure, bans the source IP once it exceeds MaxFailures
+// and sleeps exponentially longer for repeated failures
+func (g *Guard) AuthFailed(conn ssh.ConnMetadata, method string, err error) {
+	if !g.counted(method) {
+		return
+	}
+	ip := addrIP(conn.RemoteAddr())
+	user := conn.User()
+	now := time.Now()
+
+	g.mut.Lock()
+	g.prune(now)
+	if g.ips == nil {
+		g.ips = map[string][]time.Time{}
+		g.users = map[string][]time.Time{}
+	}
+	ipFailures := g.record(g.ips[ip], now)
+	userFailures := g.record(g.users[user], now)
+	g.ips[ip] = ipFailures
+	g.users[user] = userFailures
+
+	banned := false
+	if len(ipFailures) >= g.maxFailures() {
+		if _, ok := g.bans[ip]; !ok {
+			if g.bans == nil {
+				g.bans = map[string]Ban{}
+			}
+			g.bans[ip] = Ban{
+				IP:       ip,
+				Failures: len(ipFailures),
+				Since:    now,
+				Until:    now.Add(g.banTime()),
+			}
+			delete(g.ips, ip)
+			banned = true
+		}
+	}
+
+	failures := len(ipFailures)
+	if len(userFailures) > failures {
+		failures = len(userFailures)
+	}
+	g.mut.Unlock()
+
+	if banned {
+		if g.Logger != nil {
+			g.Logger.Println("banned", ip, "for", g.banTime(), "after", len(ipFailures), "failures")
+		}
+		if c, ok := conn.(io.Closer); ok {
+			c.Close()
+		}
+		return
+	}
+	time.Sleep(g.delay(failures))
+}
+
+// AuthSucceeded forgets the failures of the username
+func (g *Guard) AuthSucceeded(conn ssh.ConnMetadata, method string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	delete(g.users, conn.User())
+}
+
+func (g *Guard) delay(failures int) time.Duration {
+	d := g.baseDelay()
+	for i := 1; i < failures && d < g.maxDelay(); i++ {
+		d *= 2
+	}
+	if d > g.maxDelay() {
+		d = g.maxDelay()
+	}
+	return d
+}
+
+// maxRecords bounds the failures remembered per IP or username
+const maxRecords = 64
+
+// record appends the failure to the failures within the window
+func (g *Guard) record(failures []time.Time, now time.Time) []time.Time {
+	failures = append(g.trim(failures, now), now)
+	if len(failures) > maxRecords {
+		failures = failures[len(failures)-maxRecords:]
+	}
+	return failures
+}
+
+// trim drops the failures that fell out of the window
+func (g *Guard) trim(failures []time.Time, now time.Time) []time.Time {
+	since := now.Add(-g.window())
+	i := sort.Search(len(failures), func(i int) bool {
+		return failures[i].After(since)
+	})
+	return failures[i:]
+}
+
+// prune drops expired failures and bans at most once per window
+func (g *Guard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < g.window() {
+		return
+	}
+	g.lastPrune = now
+	for ip, failures := range g.ips {
+		if failures = g.trim(failures, now); len(failures) == 0 {
+			delete(g.ips, ip)
+		} else {
+			g.ips[ip] = failures
+		}
+	}
+	for user, failures := range g.users {
+		if failures = g.trim(failures, now); len(failures) == 0 {
+			delete(g.users, user)
+		} else {
+			g.users[user] = failures
+		}
+	}
+	for ip, ban := range g.bans {
+		if !now.Before(ban.Until) {
+			delete(g.bans, ip)
+		}
+	}
+}
+
+// Bans returns the active bans ordered by the time they expire
+func (g *Guard) Bans() []Ban {
+	now := time.Now()
+
+	g.mut.Lock()
+	bans := make([]Ban, 0, len(g.bans))
+	for _, ban := range g.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	g.mut.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// Ban bans the IP for the duration
+// If d is zero, then BanTime is used
+func (g *Guard) Ban(ip string, d time.Duration) {
+	if d <= 0 {
+		d = g.banTime()
+	}
+	now := time.Now()
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.bans == nil {
+		g.bans = map[string]Ban{}
+	}
+	g.bans[ip] = Ban{
+		IP:    ip,
+		Since: now,
+		Until: now.Add(d),
+	}
+}
+
+// Unban lifts the ban of the IP and forgets its failures
+func (g *Guard) Unban(ip string) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	_, ok := g.bans[ip]
+	delete(g.bans, ip)
+	delete(g.ips, ip)
+	return ok
+}
+
+func addrIP(addr net.Addr) string {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,102 @@
+package sshd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GetHostCertificate reads an OpenSSH host certificate and pairs it with the host key
+func GetHostCertificate(file string, key ssh.Signer, principals []string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHostCertificate(data, key, principals)
+}
+
+// ParseHostCertificate parses an OpenSSH host certificate in authorized_keys format and pairs it
+// with the host key, checking it is a valid host certificate of the key for all the principals
+func ParseHostCertificate(data []byte, key ssh.Signer, principals []string) (ssh.Signer, error) {
+	cert, err := parseHostCertificate(data, principals)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("certificate %q is not for the host key %s", cert.KeyId, ssh.FingerprintSHA256(key.PublicKey()))
+	}
+	return ssh.NewCertSigner(cert, key)
+}
+
+// ParseHostCertificateKeys is ParseHostCertificate pairing the certificate with the one of the host keys it certifies
+func ParseHostCertificateKeys(data []byte, keys []ssh.Signer, principals []string) (ssh.Signer, error) {
+	cert, err := parseHostCertificate(data, principals)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+			return ssh.NewCertSigner(cert, key)
+		}
+	}
+	return nil, fmt.Errorf("certificate %q is not for any of the host keys", cert.KeyId)
+}
+
+func parseHostCertificate(data []byte, principals []string) (*ssh.Certificate, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not a certificate")
+	}
+	err = CheckHostCertificate(cert, principals, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// CheckHostCertificate checks the certificate is a host certificate valid at the time for all the principals,
+// a certificate without principals is valid for any
+func CheckHostCertificate(cert *ssh.Certificate, principals []string, now time.Time) error {
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("certificate %q is not a host certificate", cert.KeyId)
+	}
+	if after := int64(cert.ValidAfter); after < 0 || now.Unix() < after {
+		return fmt.Errorf("certificate %q is not yet valid", cert.KeyId)
+	}
+	if before := cert.ValidBefore; before != ssh.CertTimeInfinity && (before > 1<<63-1 || now.Unix() >= int64(before)) {
+		return fmt.Errorf("certificate %q has expired", cert.KeyId)
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil
+	}
+	for _, principal := range principals {
+		found := false
+		for _, p := range cert.ValidPrincipals {
+			if p == principal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("certificate %q is not valid for %q", cert.KeyId, principal)
+		}
+	}
+	return nil
+}
+
+// CertificateExpiry returns when the certificate of the signer expires,
+// or false if it is not a certificate or it never expires
+func CertificateExpiry(signer ssh.Signer) (time.Time, bool) {
+	cert, ok := signer.PublicKey().(*ssh.Certificate)
+	if !ok || cert.ValidBefore == ssh.CertTimeInfinity || cert.ValidBefore > 1<<63-1 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(cert.ValidBefore), 0), true
+}
@@ -0,0 +1,106 @@
+package sshd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyTypes are the types of the host keys generated by GetHostKeysDir, in order of preference
+var HostKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+// GenerateHostkey generates a host key of the type, ed25519, ecdsa (P-256) or rsa (3072 bits)
+func GenerateHostkey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return nil, fmt.Errorf("unsupported host key type %q", keyType)
+}
+
+// GetHostKeysDir loads the ssh_host_<type>_key files of HostKeyTypes in the directory,
+// generating and saving those that do not exist yet
+func GetHostKeysDir(dir string) ([]ssh.Signer, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]ssh.Signer, 0, len(HostKeyTypes))
+	for _, keyType := range HostKeyTypes {
+		path := filepath.Join(dir, "ssh_host_"+keyType+"_key")
+		signer, err := GetHostkey(path)
+		if errors.Is(err, os.ErrNotExist) {
+			signer, err = generateHostkeyFile(path, keyType)
+		}
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// generateHostkeyFile generates a host key and saves it with mode 0600 in OpenSSH format,
+// along with its public key
+func generateHostkeyFile(path, keyType string) (ssh.Signer, error) {
+	key, err := GenerateHostkey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	block, err := ssh.MarshalPrivateKey(key, hostname)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(path, pem.EncodeToMemory(block), 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// writeFileAtomic writes the file through a temporary file created with the mode,
+// so it is never seen partially written nor with wider permissions
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
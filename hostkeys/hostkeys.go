@@ -0,0 +1,131 @@
+package hostkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/wzshiming/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeys lets clients learn all the host keys of the server, as with OpenSSH's UpdateHostKeys
+type HostKeys struct{}
+
+// Advertise sends the host keys of the connection after authentication
+func (h *HostKeys) Advertise(ctx context.Context, serverConn *sshd.ServerConn) {
+	keys := plainKeys(serverConn.HostKeys)
+	if len(keys) == 0 {
+		return
+	}
+	var payload []byte
+	for _, key := range keys {
+		payload = appendString(payload, key.PublicKey().Marshal())
+	}
+	_, _, err := serverConn.SendRequest(name, false, payload)
+	if err != nil {
+		if serverConn.Logger != nil {
+			serverConn.Logger.Println("error sending", name, err)
+		}
+	}
+}
+
+// Prove signs the host keys requested by the client to prove the server owns them
+func (h *HostKeys) Prove(ctx context.Context, req *ssh.Request, serverConn *sshd.ServerConn) {
+	sigs, err := h.prove(req.Payload, serverConn)
+	if err != nil {
+		if serverConn.Logger != nil {
+			serverConn.Logger.Println("error proving host keys:", err)
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+	if req.WantReply {
+		req.Reply(true, sigs)
+	}
+}
+
+func (h *HostKeys) prove(payload []byte, serverConn *sshd.ServerConn) ([]byte, error) {
+	keys := plainKeys(serverConn.HostKeys)
+	var reply []byte
+	for len(payload) != 0 {
+		blob, rest, ok := parseString(payload)
+		if !ok {
+			return nil, fmt.Errorf("malformed %s request", proveName)
+		}
+		payload = rest
+
+		var signer ssh.Signer
+		for _, key := range keys {
+			if bytes.Equal(key.PublicKey().Marshal(), blob) {
+				signer = key
+				break
+			}
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("unknown host key requested")
+		}
+
+		data := ssh.Marshal(struct {
+			Name      string
+			SessionID []byte
+			Key       []byte
+		}{proveName, serverConn.SessionID(), blob})
+		sig, err := sign(signer, data, serverConn.HostKeyAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		reply = appendString(reply, ssh.Marshal(sig))
+	}
+	return reply, nil
+}
+
+// sign signs the data, RSA keys with the algorithm of the key exchange if it was an RSA one
+// or with rsa-sha2-512, as OpenSSH clients expect
+func sign(signer ssh.Signer, data []byte, kexAlgorithm string) (*ssh.Signature, error) {
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		algorithm := ssh.KeyAlgoRSASHA512
+		switch kexAlgorithm {
+		case ssh.KeyAlgoRSA, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512:
+			algorithm = kexAlgorithm
+		}
+		algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, fmt.Errorf("rsa host key can not sign with %s", algorithm)
+		}
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// plainKeys returns the host keys that are not certificates
+func plainKeys(keys []ssh.Signer) []ssh.Signer {
+	plain := make([]ssh.Signer, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := key.PublicKey().(*ssh.Certificate); !ok {
+			plain = append(plain, key)
+		}
+	}
+	return plain
+}
+
+func appendString(buf []byte, s []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func parseString(in []byte) (out, rest []byte, ok bool) {
+	if len(in) < 4 {
+		return nil, nil, false
+	}
+	length := binary.BigEndian.Uint32(in)
+	in = in[4:]
+	if uint32(len(in)) < length {
+		return nil, nil, false
+	}
+	return in[:length], in[length:], true
+}
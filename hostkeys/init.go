@@ -0,0 +1,16 @@
+package hostkeys
+
+import (
+	"github.com/wzshiming/sshd"
+)
+
+var (
+	name      = "hostkeys-00@openssh.com"
+	proveName = "hostkeys-prove-00@openssh.com"
+)
+
+func init() {
+	hostKeys := &HostKeys{}
+	sshd.RegistryHandleConn(name, hostKeys.Advertise)
+	sshd.RegistryHandleRequest(proveName, hostKeys.Prove)
+}
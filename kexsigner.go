@@ -0,0 +1,57 @@
+package sshd
+
+import (
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// recordHostKeyAlgorithm wraps the host key to record the signature algorithm of the first key exchange,
+// keeping the signer interfaces that decide the algorithms the key is offered with
+func recordHostKeyAlgorithm(key ssh.Signer, auth *connAuth) ssh.Signer {
+	switch k := key.(type) {
+	case ssh.MultiAlgorithmSigner:
+		return &kexMultiAlgorithmSigner{kexAlgorithmSigner{k, auth}, k.Algorithms()}
+	case ssh.AlgorithmSigner:
+		return &kexAlgorithmSigner{k, auth}
+	}
+	return &kexSigner{key, auth}
+}
+
+func (a *connAuth) recordSignature(sig *ssh.Signature, err error) (*ssh.Signature, error) {
+	if err == nil && a.hostKeyAlgorithm == "" {
+		a.hostKeyAlgorithm = sig.Format
+	}
+	return sig, err
+}
+
+type kexSigner struct {
+	ssh.Signer
+	auth *connAuth
+}
+
+func (k *kexSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return k.auth.recordSignature(k.Signer.Sign(rand, data))
+}
+
+type kexAlgorithmSigner struct {
+	ssh.AlgorithmSigner
+	auth *connAuth
+}
+
+func (k *kexAlgorithmSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return k.auth.recordSignature(k.AlgorithmSigner.Sign(rand, data))
+}
+
+func (k *kexAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	return k.auth.recordSignature(k.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm))
+}
+
+type kexMultiAlgorithmSigner struct {
+	kexAlgorithmSigner
+	algorithms []string
+}
+
+func (k *kexMultiAlgorithmSigner) Algorithms() []string {
+	return k.algorithms
+}
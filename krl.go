@@ -0,0 +1,460 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RevocationList reports whether a public key or certificate is revoked
+type RevocationList interface {
+	IsRevoked(key ssh.PublicKey) bool
+}
+
+// KRL sections, see PROTOCOL.krl of OpenSSH
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+// RevokedKeys is a set of revoked keys and certificates
+type RevokedKeys struct {
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+	certs  []*revokedCerts
+}
+
+// revokedCerts are the certificates revoked for a CA
+type revokedCerts struct {
+	// ca is the marshaled CA key, or nil for any CA
+	ca      []byte
+	serials map[uint64]bool
+	ranges  [][2]uint64
+	keyIDs  map[string]bool
+}
+
+func newRevokedKeys() *RevokedKeys {
+	return &RevokedKeys{
+		keys:   map[string]bool{},
+		sha1:   map[string]bool{},
+		sha256: map[string]bool{},
+	}
+}
+
+// IsRevoked reports whether the key is revoked, for a certificate this includes
+// its serial and key ID, its key and the key of its CA
+func (r *RevokedKeys) IsRevoked(key ssh.PublicKey) bool {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return r.isKeyRevoked(key)
+	}
+	if r.isKeyRevoked(cert.Key) || r.isKeyRevoked(cert.SignatureKey) {
+		return true
+	}
+	ca := cert.SignatureKey.Marshal()
+	for _, c := range r.certs {
+		if c.ca != nil && !bytes.Equal(c.ca, ca) {
+			continue
+		}
+		if c.isRevoked(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RevokedKeys) isKeyRevoked(key ssh.PublicKey) bool {
+	data := key.Marshal()
+	if r.keys[string(data)] {
+		return true
+	}
+	sum1 := sha1.Sum(data)
+	if r.sha1[string(sum1[:])] {
+		return true
+	}
+	sum256 := sha256.Sum256(data)
+	return r.sha256[string(sum256[:])]
+}
+
+func (c *revokedCerts) isRevoked(cert *ssh.Certificate) bool {
+	if c.keyIDs[cert.KeyId] {
+		return true
+	}
+	// Serial zero is never revoked by serial, see PROTOCOL.krl
+	if cert.Serial == 0 {
+		return false
+	}
+	if c.serials[cert.Serial] {
+		return true
+	}
+	for _, r := range c.ranges {
+		if cert.Serial >= r[0] && cert.Serial <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRevokedKeysFile reads an OpenSSH KRL or a plain list of revoked public keys
+func GetRevokedKeysFile(file string) (*RevokedKeys, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRevokedKeys(data)
+}
+
+// ParseRevokedKeys parses an OpenSSH KRL, or otherwise a plain list of revoked public keys
+// in authorized_keys format, where lines may also be SHA256: fingerprints
+func ParseRevokedKeys(data []byte) (*RevokedKeys, error) {
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		return ParseKRL(data)
+	}
+	return parseRevokedKeysList(data)
+}
+
+func parseRevokedKeysList(data []byte) (*RevokedKeys, error) {
+	r := newRevokedKeys()
+	read := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, _, err := read.ReadLine()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		text := strings.TrimSpace(string(line))
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if fp, ok := strings.CutPrefix(text, "SHA256:"); ok {
+			sum, err := base64.RawStdEncoding.DecodeString(strings.Fields(fp)[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid fingerprint %q: %w", text, err)
+			}
+			r.sha256[string(sum)] = true
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid revoked key %q: %w", text, err)
+		}
+		r.keys[string(key.Marshal())] = true
+	}
+	return r, nil
+}
+
+// ParseKRL parses an OpenSSH key revocation list,
+// the optional signature sections are not verified
+func ParseKRL(data []byte) (*RevokedKeys, error) {
+	p := krlParser{data}
+	magic, ok := p.bytes(len(krlMagic))
+	if !ok || string(magic) != krlMagic {
+		return nil, errors.New("krl: bad magic")
+	}
+	version, ok := p.uint32()
+	if !ok || version != krlFormatVersion {
+		return nil, fmt.Errorf("krl: unsupported format version %d", version)
+	}
+	// krl_version, generated_date, flags, reserved, comment
+	if _, ok = p.uint64(); !ok {
+		return nil, errKRLShort
+	}
+	if _, ok = p.uint64(); !ok {
+		return nil, errKRLShort
+	}
+	if _, ok = p.uint64(); !ok {
+		return nil, errKRLShort
+	}
+	if _, ok = p.string(); !ok {
+		return nil, errKRLShort
+	}
+	if _, ok = p.string(); !ok {
+		return nil, errKRLShort
+	}
+
+	r := newRevokedKeys()
+	for len(p.data) > 0 {
+		typ, ok := p.byte()
+		if !ok {
+			return nil, errKRLShort
+		}
+		section, ok := p.string()
+		if !ok {
+			return nil, errKRLShort
+		}
+		s := krlParser{section}
+		switch typ {
+		case krlSectionCertificates:
+			certs, err := parseKRLCertificates(s)
+			if err != nil {
+				return nil, err
+			}
+			r.certs = append(r.certs, certs)
+		case krlSectionExplicitKey:
+			err := s.eachString(func(b []byte) { r.keys[string(b)] = true })
+			if err != nil {
+				return nil, err
+			}
+		case krlSectionFingerprintSHA1:
+			err := s.eachString(func(b []byte) { r.sha1[string(b)] = true })
+			if err != nil {
+				return nil, err
+			}
+		case krlSectionFingerprintSHA256:
+			err := s.eachString(func(b []byte) { r.sha256[string(b)] = true })
+			if err != nil {
+				return nil, err
+			}
+		case krlSectionSignature:
+			// Signatures are trailing, nothing after them is revocation data
+			return r, nil
+		default:
+			return nil, fmt.Errorf("krl: unsupported section %d", typ)
+		}
+	}
+	return r, nil
+}
+
+var errKRLShort = errors.New("krl: truncated data")
+
+func parseKRLCertificates(p krlParser) (*revokedCerts, error) {
+	ca, ok := p.string()
+	if !ok {
+		return nil, errKRLShort
+	}
+	if _, ok = p.string(); !ok {
+		return nil, errKRLShort
+	}
+	c := &revokedCerts{
+		serials: map[uint64]bool{},
+		keyIDs:  map[string]bool{},
+	}
+	if len(ca) != 0 {
+		key, err := ssh.ParsePublicKey(ca)
+		if err != nil {
+			return nil, fmt.Errorf("krl: invalid CA key: %w", err)
+		}
+		c.ca = key.Marshal()
+	}
+
+	for len(p.data) > 0 {
+		typ, ok := p.byte()
+		if !ok {
+			return nil, errKRLShort
+		}
+		section, ok := p.string()
+		if !ok {
+			return nil, errKRLShort
+		}
+		s := krlParser{section}
+		switch typ {
+		case krlSectionCertSerialList:
+			for len(s.data) > 0 {
+				serial, ok := s.uint64()
+				if !ok {
+					return nil, errKRLShort
+				}
+				c.serials[serial] = true
+			}
+		case krlSectionCertSerialRange:
+			min, ok1 := s.uint64()
+			max, ok2 := s.uint64()
+			if !ok1 || !ok2 {
+				return nil, errKRLShort
+			}
+			c.ranges = append(c.ranges, [2]uint64{min, max})
+		case krlSectionCertSerialBitmap:
+			offset, ok := s.uint64()
+			if !ok {
+				return nil, errKRLShort
+			}
+			bitmap, ok := s.string()
+			if !ok {
+				return nil, errKRLShort
+			}
+			bits := new(big.Int).SetBytes(bitmap)
+			for i := 0; i < bits.BitLen(); i++ {
+				if bits.Bit(i) == 1 {
+					c.serials[offset+uint64(i)] = true
+				}
+			}
+		case krlSectionCertKeyID:
+			err := s.eachString(func(b []byte) { c.keyIDs[string(b)] = true })
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("krl: unsupported certificate section %d", typ)
+		}
+	}
+	return c, nil
+}
+
+type krlParser struct {
+	data []byte
+}
+
+func (p *krlParser) bytes(n int) ([]byte, bool) {
+	if n < 0 || len(p.data) < n {
+		return nil, false
+	}
+	b := p.data[:n]
+	p.data = p.data[n:]
+	return b, true
+}
+
+func (p *krlParser) byte() (byte, bool) {
+	b, ok := p.bytes(1)
+	if !ok {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func (p *krlParser) uint32() (uint32, bool) {
+	b, ok := p.bytes(4)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
+
+func (p *krlParser) uint64() (uint64, bool) {
+	b, ok := p.bytes(8)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(b), true
+}
+
+func (p *krlParser) string() ([]byte, bool) {
+	n, ok := p.uint32()
+	if !ok {
+		return nil, false
+	}
+	return p.bytes(int(n))
+}
+
+func (p *krlParser) eachString(fun func([]byte)) error {
+	for len(p.data) > 0 {
+		b, ok := p.string()
+		if !ok {
+			return errKRLShort
+		}
+		fun(b)
+	}
+	return nil
+}
+
+// RevokedKeysFile is a KRL or revoked keys list file that is reloaded when it changes
+type RevokedKeysFile struct {
+	// Logger error log
+	Logger Logger
+
+	path    string
+	mut     sync.Mutex
+	keys    *RevokedKeys
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// NewRevokedKeysFile loads the file, which is reloaded once it changes
+func NewRevokedKeysFile(path string) (*RevokedKeysFile, error) {
+	f := &RevokedKeysFile{path: path}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again
+func (f *RevokedKeysFile) Reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	keys, err := GetRevokedKeysFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.keys = keys
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// IsRevoked reports whether the key is revoked, reloading the file first if it changed
+func (f *RevokedKeysFile) IsRevoked(key ssh.PublicKey) bool {
+	return f.current().IsRevoked(key)
+}
+
+// current returns the revoked keys, checking the file for changes at most once a second
+func (f *RevokedKeysFile) current() *RevokedKeys {
+	f.mut.Lock()
+	keys := f.keys
+	stale := time.Since(f.checked) >= time.Second
+	if stale {
+		f.checked = time.Now()
+	}
+	modTime, size := f.modTime, f.size
+	f.mut.Unlock()
+	if !stale {
+		return keys
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		if f.Logger != nil {
+			f.Logger.Println("revoked keys:", err)
+		}
+		return keys
+	}
+	if info.ModTime().Equal(modTime) && info.Size() == size {
+		return keys
+	}
+	err = f.Reload()
+	if err != nil {
+		// Keep the last good list rather than accepting revoked keys
+		if f.Logger != nil {
+			f.Logger.Println("revoked keys: reload:", err)
+		}
+		return keys
+	}
+	if f.Logger != nil {
+		f.Logger.Println("revoked keys: reloaded", f.path)
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.keys
+}
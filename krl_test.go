@@ -0,0 +1,149 @@
+package sshd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func readTestKey(t *testing.T, name string) ssh.PublicKey {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "krl", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testdata/krl/revoked.krl is made by ssh-keygen -k from the spec
+//
+//	serial: 1, 5-9, 60-62, 64, 66, 68, 70, 1000-2000
+//	id: revoked-id
+//
+// for certificates of ca.pub, and revokes revoked_key.pub explicitly,
+// revoked_sha256.pub by its SHA256 and revoked_sha1.pub by its SHA1 fingerprint
+func TestParseKRL(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "krl", "revoked.krl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	krl, err := ParseRevokedKeys(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"good.pub", false},
+		{"user.pub", false},
+		{"revoked_key.pub", true},
+		{"revoked_sha256.pub", true},
+		{"revoked_sha1.pub", true},
+		{"cert_serial_0.pub", false},
+		{"cert_serial_1.pub", true},
+		{"cert_serial_5.pub", true},
+		{"cert_serial_9.pub", true},
+		{"cert_serial_10.pub", false},
+		{"cert_serial_60.pub", true},
+		{"cert_serial_61.pub", true},
+		{"cert_serial_63.pub", false},
+		{"cert_serial_64.pub", true},
+		{"cert_serial_99.pub", false},
+		{"cert_serial_1500.pub", true},
+		{"cert_serial_2001.pub", false},
+		{"cert_keyid.pub", true},
+		{"cert_other_ca_serial_5.pub", false},
+		{"cert_revoked_key_serial_99.pub", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			if got := krl.IsRevoked(readTestKey(t, tt.file)); got != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKRLSerialList(t *testing.T) {
+	ca := readTestKey(t, "ca.pub")
+	serials := ssh.Marshal(struct{ A, B uint64 }{1, 99})
+	certs := ssh.Marshal(struct {
+		CA       []byte
+		Reserved string
+	}{ca.Marshal(), ""})
+	certs = append(certs, krlSectionCertSerialList)
+	certs = append(certs, ssh.Marshal(struct{ S []byte }{serials})...)
+
+	data := []byte(krlMagic)
+	data = append(data, ssh.Marshal(struct {
+		Version                uint32
+		KRLVersion, Date, Flag uint64
+		Reserved, Comment      string
+	}{Version: krlFormatVersion})...)
+	data = append(data, krlSectionCertificates)
+	data = append(data, ssh.Marshal(struct{ S []byte }{certs})...)
+
+	krl, err := ParseKRL(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"cert_serial_1.pub", true},
+		{"cert_serial_5.pub", false},
+		{"cert_serial_99.pub", true},
+		{"cert_other_ca_serial_5.pub", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			if got := krl.IsRevoked(readTestKey(t, tt.file)); got != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, err = ParseKRL(data[:len(data)-3])
+	if err == nil {
+		t.Error("ParseKRL() of truncated data succeeded")
+	}
+}
+
+func TestParseRevokedKeysList(t *testing.T) {
+	revoked, err := os.ReadFile(filepath.Join("testdata", "krl", "revoked_key.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := ssh.FingerprintSHA256(readTestKey(t, "revoked_sha256.pub"))
+	data := "# revoked\n\n" + string(revoked) + fingerprint + " comment\n"
+	krl, err := ParseRevokedKeys([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"good.pub", false},
+		{"revoked_key.pub", true},
+		{"revoked_sha256.pub", true},
+		{"cert_revoked_key_serial_99.pub", true},
+		{"cert_serial_1.pub", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			if got := krl.IsRevoked(readTestKey(t, tt.file)); got != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package sshd
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MaxStartups randomly drops unauthenticated connections like the MaxStartups of OpenSSH
+// Once Start unauthenticated connections are pending, new connections are dropped
+// with a probability of Rate percent, increasing linearly up to 100% at Full
+// If Start is zero, then nothing is dropped
+type MaxStartups struct {
+	Start int
+	Rate  int
+	Full  int
+}
+
+// ParseMaxStartups parses "start:rate:full" or "start"
+func ParseMaxStartups(s string) (MaxStartups, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 1 && len(parts) != 3 {
+		return MaxStartups{}, fmt.Errorf("invalid max startups %q", s)
+	}
+	nums := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return MaxStartups{}, fmt.Errorf("invalid max startups %q", s)
+		}
+		nums = append(nums, n)
+	}
+	if len(nums) == 1 {
+		return MaxStartups{Start: nums[0], Rate: 100, Full: nums[0]}, nil
+	}
+	m := MaxStartups{Start: nums[0], Rate: nums[1], Full: nums[2]}
+	if m.Rate > 100 || m.Full < m.Start {
+		return MaxStartups{}, fmt.Errorf("invalid max startups %q", s)
+	}
+	return m, nil
+}
+
+// drop reports whether a new connection should be dropped
+// while the number of unauthenticated connections is startups
+func (m MaxStartups) drop(startups int) bool {
+	if m.Start <= 0 || startups < m.Start {
+		return false
+	}
+	if startups >= m.Full {
+		return true
+	}
+	p := m.Rate + (100-m.Rate)*(startups-m.Start)/(m.Full-m.Start)
+	return rand.Intn(100) < p
+}
+
+// connSlot is the reservation of a connection against the limits of the server
+type connSlot struct {
+	server        *Server
+	ip            string
+	authenticated bool
+}
+
+// acquireConn reserves a slot for the new connection,
+// the slot must be released once the connection is closed
+func (s *Server) acquireConn(addr net.Addr) (*connSlot, error) {
+	ip := addrIP(addr)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.MaxConnections > 0 && s.connCount >= s.MaxConnections {
+		return nil, fmt.Errorf("too many connections")
+	}
+	if s.MaxConnectionsPerIP > 0 && s.connsPerIP[ip] >= s.MaxConnectionsPerIP {
+		return nil, fmt.Errorf("too many connections from %s", ip)
+	}
+	if s.MaxStartups.drop(s.startups) {
+		return nil, fmt.Errorf("too many unauthenticated connections")
+	}
+
+	if s.connsPerIP == nil {
+		s.connsPerIP = map[string]int{}
+	}
+	s.connCount++
+	s.connsPerIP[ip]++
+	s.startups++
+	return &connSlot{server: s, ip: ip}, nil
+}
+
+// authenticate stops counting the connection as unauthenticated
+func (c *connSlot) authenticate() {
+	s := c.server
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !c.authenticated {
+		c.authenticated = true
+		s.startups--
+	}
+}
+
+// release frees the slot of the closed connection
+func (c *connSlot) release() {
+	s := c.server
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !c.authenticated {
+		c.authenticated = true
+		s.startups--
+	}
+	s.connCount--
+	s.connsPerIP[c.ip]--
+	if s.connsPerIP[c.ip] <= 0 {
+		delete(s.connsPerIP, c.ip)
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
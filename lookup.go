@@ -0,0 +1,315 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxLookupSize bounds the output read from a lookup
+const maxLookupSize = 1 << 20
+
+// Lookup resolves lines of text for a user by running a command or querying an HTTP endpoint,
+// like OpenSSH's AuthorizedKeysCommand and AuthorizedPrincipalsCommand
+//
+// The tokens %u, %t, %f and %k in Command and URL are replaced by the username, key type,
+// SHA256 fingerprint and base64 encoded key, and %% by a single %
+type Lookup struct {
+	// Command is the program and its arguments, run without a shell
+	// If no argument has a token, then the username, and the key type and fingerprint if any, are appended
+	Command []string
+	// URL is the endpoint queried with GET when Command is empty, a 404 response means no lines
+	// If it has no token, then the user, type and fingerprint query parameters are added
+	URL string
+	// Client queries the URL
+	// If nil, then http.DefaultClient
+	Client *http.Client
+	// Timeout bounds each command run or request
+	// If zero, then 10 seconds
+	Timeout time.Duration
+	// CacheTTL is how long the results are cached, only results with lines are cached
+	// If zero, then the results are not cached
+	CacheTTL time.Duration
+	// CacheSize is the most results cached, the one expiring first is dropped for a new one
+	// If zero, then 1024
+	CacheSize int
+	// Logger error log
+	Logger Logger
+
+	mut   sync.Mutex
+	cache map[string]lookupEntry
+}
+
+type lookupEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+func (l *Lookup) cacheSize() int {
+	if l.CacheSize <= 0 {
+		return 1024
+	}
+	return l.CacheSize
+}
+
+func (l *Lookup) timeout() time.Duration {
+	if l.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return l.Timeout
+}
+
+// Lookup returns the output for the user and key, the key may be nil
+func (l *Lookup) Lookup(ctx context.Context, user string, key ssh.PublicKey) ([]byte, error) {
+	tokens := lookupTokens(user, key)
+	cacheKey := tokens["%u"] + " " + tokens["%k"]
+	if data, ok := l.cached(cacheKey); ok {
+		return data, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.timeout())
+	defer cancel()
+	var data []byte
+	var err error
+	switch {
+	case len(l.Command) != 0:
+		data, err = l.run(ctx, tokens)
+	case l.URL != "":
+		data, err = l.get(ctx, tokens)
+	default:
+		return nil, fmt.Errorf("lookup has no command or url")
+	}
+	if err != nil {
+		if l.Logger != nil {
+			l.Logger.Println("lookup for", user, "failed:", err)
+		}
+		return nil, err
+	}
+	l.store(cacheKey, data)
+	return data, nil
+}
+
+func (l *Lookup) cached(key string) ([]byte, bool) {
+	if l.CacheTTL <= 0 {
+		return nil, false
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	entry, ok := l.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (l *Lookup) store(key string, data []byte) {
+	// Empty results are not cached, unknown users would fill the cache
+	if l.CacheTTL <= 0 || len(bytes.TrimSpace(data)) == 0 {
+		return
+	}
+	now := time.Now()
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.cache == nil {
+		l.cache = map[string]lookupEntry{}
+	}
+	for k, entry := range l.cache {
+		if now.After(entry.expires) {
+			delete(l.cache, k)
+		}
+	}
+	if _, ok := l.cache[key]; !ok && len(l.cache) >= l.cacheSize() {
+		oldest := ""
+		for k, entry := range l.cache {
+			if oldest == "" || entry.expires.Before(l.cache[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(l.cache, oldest)
+	}
+	l.cache[key] = lookupEntry{
+		data:    data,
+		expires: now.Add(l.CacheTTL),
+	}
+}
+
+func (l *Lookup) run(ctx context.Context, tokens map[string]string) ([]byte, error) {
+	args := make([]string, 0, len(l.Command)+3)
+	expanded := false
+	for _, arg := range l.Command {
+		a := expandTokens(arg, tokens, nil)
+		if a != arg {
+			expanded = true
+		}
+		args = append(args, a)
+	}
+	if !expanded {
+		args = append(args, tokens["%u"])
+		if tokens["%t"] != "" {
+			args = append(args, tokens["%t"], tokens["%f"])
+		}
+	}
+
+	var stdout limitedBuffer
+	var stderr bytes.Buffer
+	stdout.limit = maxLookupSize
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("lookup command %s: %w: %s", args[0], err, msg)
+		}
+		return nil, fmt.Errorf("lookup command %s: %w", args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (l *Lookup) get(ctx context.Context, tokens map[string]string) ([]byte, error) {
+	u := expandTokens(l.URL, tokens, url.QueryEscape)
+	if u == l.URL {
+		parsed, err := url.Parse(l.URL)
+		if err != nil {
+			return nil, err
+		}
+		query := parsed.Query()
+		query.Set("user", tokens["%u"])
+		query.Set("type", tokens["%t"])
+		query.Set("fingerprint", tokens["%f"])
+		parsed.RawQuery = query.Encode()
+		u = parsed.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := l.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("lookup %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLookupSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxLookupSize {
+		return nil, fmt.Errorf("lookup %s: response too large", req.URL.Redacted())
+	}
+	return data, nil
+}
+
+func lookupTokens(user string, key ssh.PublicKey) map[string]string {
+	tokens := map[string]string{
+		"%u": user,
+		"%t": "",
+		"%f": "",
+		"%k": "",
+	}
+	if key != nil {
+		tokens["%t"] = key.Type()
+		tokens["%f"] = ssh.FingerprintSHA256(key)
+		tokens["%k"] = base64.StdEncoding.EncodeToString(key.Marshal())
+	}
+	return tokens
+}
+
+// expandTokens replaces the tokens in s, escaping the values
+func expandTokens(s string, tokens map[string]string, escape func(string) string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		token := s[i : i+2]
+		if token == "%%" {
+			out.WriteByte('%')
+			i++
+			continue
+		}
+		value, ok := tokens[token]
+		if !ok {
+			out.WriteByte(s[i])
+			continue
+		}
+		if escape != nil {
+			value = escape(value)
+		}
+		out.WriteString(value)
+		i++
+	}
+	return out.String()
+}
+
+// limitedBuffer is a bytes.Buffer failing writes past the limit
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, fmt.Errorf("output too large")
+	}
+	return b.Buffer.Write(p)
+}
+
+// AuthorizedLookup authenticates keys by the authorized_keys lines resolved for the user
+type AuthorizedLookup struct {
+	// Lookup resolves the authorized_keys lines of the user
+	Lookup *Lookup
+}
+
+// PublicKeyCallback authenticates the key with the options of the looked up lines,
+// it can be used as ssh.ServerConfig.PublicKeyCallback
+func (a *AuthorizedLookup) PublicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	data, err := a.Lookup.Lookup(context.Background(), conn.User(), key)
+	if err != nil {
+		return nil, err
+	}
+	authorized, err := ParseAuthorized(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return authorized.PublicKeyCallback(conn, key)
+}
+
+// Principals returns the principals resolved for the user, one per line,
+// it can be used as CertAuthority.AuthorizedPrincipals
+func (l *Lookup) Principals(user string) []string {
+	data, err := l.Lookup(context.Background(), user, nil)
+	if err != nil {
+		return nil
+	}
+	principals := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			principals = append(principals, line)
+		}
+	}
+	return principals
+}
@@ -0,0 +1,98 @@
+package sshd
+
+import (
+	"net"
+	"strings"
+)
+
+// MatchPattern reports whether s matches the pattern,
+// where '*' matches any sequence of characters and '?' matches any single character
+func MatchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if MatchPattern(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return s == ""
+}
+
+// MatchPatternList reports whether s matches the comma separated list of patterns
+// A pattern prefixed with '!' negates the match, and any negated match fails the whole list
+func MatchPatternList(patterns string, s string) bool {
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		if MatchPattern(pattern, s) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// MatchAddrList reports whether the IP matches the comma separated list of
+// CIDRs and address patterns, with the negation of MatchPatternList
+func MatchAddrList(patterns string, ip net.IP) bool {
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		var ok bool
+		if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+			ok = ipNet.Contains(ip)
+		} else {
+			ok = MatchPattern(pattern, ip.String())
+		}
+		if ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// remoteIP returns the IP of the address, or nil
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
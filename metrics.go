@@ -0,0 +1,205 @@
+package sshd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wzshiming/sshd/metrics"
+	"golang.org/x/crypto/ssh"
+)
+
+// Metrics collects server statistics and exposes them in the Prometheus text format
+// All methods are safe to call on a nil *Metrics, which records nothing
+type Metrics struct {
+	// Registry contains all the server metrics
+	Registry *metrics.Registry
+
+	handshakes       *metrics.CounterVec
+	authAttempts     *metrics.CounterVec
+	connections      *metrics.GaugeVec
+	rejected         *metrics.CounterVec
+	channels         *metrics.CounterVec
+	tunnelBytes      *metrics.CounterVec
+	forwardListeners *metrics.GaugeVec
+	execDuration     *metrics.HistogramVec
+}
+
+// NewMetrics returns Metrics registered in a new registry
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+	return &Metrics{
+		Registry:         r,
+		handshakes:       r.NewCounterVec("sshd_handshakes_total", "SSH handshakes by result and failure reason.", "result", "reason"),
+		authAttempts:     r.NewCounterVec("sshd_auth_attempts_total", "Authentication attempts by method and result.", "method", "result"),
+		connections:      r.NewGaugeVec("sshd_connections_active", "Number of established connections."),
+		rejected:         r.NewCounterVec("sshd_connections_rejected_total", "Connections refused by connection limits or guard bans."),
+		channels:         r.NewCounterVec("sshd_channels_total", "Channels opened or rejected by type.", "type", "result"),
+		tunnelBytes:      r.NewCounterVec("sshd_tunnel_bytes_total", "Bytes transferred through tunnels by channel type and direction.", "type", "direction"),
+		forwardListeners: r.NewGaugeVec("sshd_forward_listeners_active", "Number of active remote forward listeners by type.", "type"),
+		execDuration:     r.NewHistogramVec("sshd_session_exec_duration_seconds", "Duration of commands executed in sessions.", nil, "result"),
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	m.Registry.ServeHTTP(w, r)
+}
+
+// HandshakeSucceeded records a successful handshake
+func (m *Metrics) HandshakeSucceeded() {
+	if m == nil {
+		return
+	}
+	m.handshakes.WithLabelValues("success", "").Inc()
+}
+
+// HandshakeFailed records a failed handshake
+func (m *Metrics) HandshakeFailed(err error) {
+	if m == nil {
+		return
+	}
+	m.handshakes.WithLabelValues("failure", handshakeFailureReason(err)).Inc()
+}
+
+func handshakeFailureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	}
+	str := err.Error()
+	switch {
+	case strings.Contains(str, "no auth passed yet"),
+		strings.Contains(str, "unable to authenticate"),
+		strings.Contains(str, "too many authentication failures"):
+		return "auth"
+	case strings.Contains(str, "no common algorithm"):
+		return "negotiation"
+	case strings.Contains(str, "overflows") || strings.Contains(str, "invalid packet"):
+		return "protocol"
+	}
+	return "other"
+}
+
+// AuthAttempt records an authentication attempt with the given method
+func (m *Metrics) AuthAttempt(method string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		var partial *ssh.PartialSuccessError
+		if errors.As(err, &partial) {
+			result = "partial"
+		} else {
+			result = "failure"
+		}
+	}
+	m.authAttempts.WithLabelValues(method, result).Inc()
+}
+
+// ConnectionOpened records an established connection
+func (m *Metrics) ConnectionOpened() {
+	if m == nil {
+		return
+	}
+	m.connections.WithLabelValues().Inc()
+}
+
+// ConnectionClosed records a closed connection
+func (m *Metrics) ConnectionClosed() {
+	if m == nil {
+		return
+	}
+	m.connections.WithLabelValues().Dec()
+}
+
+// ConnectionRejected records a connection refused by connection limits or a guard ban
+func (m *Metrics) ConnectionRejected() {
+	if m == nil {
+		return
+	}
+	m.rejected.WithLabelValues().Inc()
+}
+
+// ChannelOpened records an accepted channel
+func (m *Metrics) ChannelOpened(chType string) {
+	if m == nil {
+		return
+	}
+	m.channels.WithLabelValues(chType, "opened").Inc()
+}
+
+// ChannelRejected records a rejected channel
+func (m *Metrics) ChannelRejected(chType string) {
+	if m == nil {
+		return
+	}
+	m.channels.WithLabelValues(chType, "rejected").Inc()
+}
+
+// TunnelBytes records bytes transferred through a tunnel
+// direction is "in" for data from the client and "out" for data to the client
+func (m *Metrics) TunnelBytes(chType, direction string, n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.tunnelBytes.WithLabelValues(chType, direction).Add(float64(n))
+}
+
+// ForwardListenerOpened records an active remote forward listener
+func (m *Metrics) ForwardListenerOpened(typ string) {
+	if m == nil {
+		return
+	}
+	m.forwardListeners.WithLabelValues(typ).Inc()
+}
+
+// ForwardListenerClosed records a closed remote forward listener
+func (m *Metrics) ForwardListenerClosed(typ string) {
+	if m == nil {
+		return
+	}
+	m.forwardListeners.WithLabelValues(typ).Dec()
+}
+
+// ExecDuration records the duration of a command executed in a session
+func (m *Metrics) ExecDuration(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.execDuration.WithLabelValues(result).Observe(d.Seconds())
+}
+
+// metricsNewChannel records whether a new channel was accepted or rejected
+type metricsNewChannel struct {
+	ssh.NewChannel
+	metrics *Metrics
+}
+
+func (n *metricsNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := n.NewChannel.Accept()
+	if err == nil {
+		n.metrics.ChannelOpened(n.ChannelType())
+	}
+	return ch, reqs, err
+}
+
+func (n *metricsNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	n.metrics.ChannelRejected(n.ChannelType())
+	return n.NewChannel.Reject(reason, message)
+}
@@ -0,0 +1,372 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metrics and exposes them in the Prometheus text format
+type Registry struct {
+	mut        sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// NewCounterVec registers a counter partitioned by the given labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// NewGaugeVec registers a gauge partitioned by the given labels
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// NewHistogramVec registers a histogram partitioned by the given labels
+// If buckets is nil, then DefBuckets is used
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{vec: newVec(name, help, "histogram", labels), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// WriteTo writes all registered metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mut.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mut.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP implements http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mut    sync.RWMutex
+	values map[string]interface{}
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: map[string]interface{}{},
+	}
+}
+
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mut.RLock()
+	m, ok := v.values[key]
+	v.mut.RUnlock()
+	if ok {
+		return m
+	}
+
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	m, ok = v.values[key]
+	if !ok {
+		m = create()
+		v.values[key] = m
+	}
+	return m
+}
+
+func (v *vec) each(fun func(labels string, m interface{})) {
+	v.mut.RLock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ms := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		ms = append(ms, v.values[key])
+	}
+	v.mut.RUnlock()
+
+	for i, key := range keys {
+		fun(v.formatLabels(key), ms[i])
+	}
+}
+
+func (v *vec) formatLabels(key string) string {
+	if len(v.labels) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, 0, len(v.labels))
+	for i, label := range v.labels {
+		pairs = append(pairs, label+"="+quoteLabel(values[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v *vec) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(s string) string {
+	return `"` + labelReplacer.Replace(s) + `"`
+}
+
+func escapeHelp(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	if labels == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// value is a float64 updated atomically
+type value struct {
+	bits uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) Set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v value
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add adds the given non-negative value to the counter
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.v.Add(delta)
+}
+
+// Value returns the current value
+func (c *Counter) Value() float64 {
+	return c.v.Get()
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	vec
+}
+
+// WithLabelValues returns the counter for the given label values
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	return c.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, m interface{}) {
+		writeSample(w, c.name, labels, m.(*Counter).Value())
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v value
+}
+
+// Inc increments the gauge by 1
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+// Dec decrements the gauge by 1
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+// Add adds the given value to the gauge
+func (g *Gauge) Add(delta float64) {
+	g.v.Add(delta)
+}
+
+// Set sets the gauge to the given value
+func (g *Gauge) Set(f float64) {
+	g.v.Set(f)
+}
+
+// Value returns the current value
+func (g *Gauge) Value() float64 {
+	return g.v.Get()
+}
+
+// GaugeVec is a set of gauges partitioned by label values
+type GaugeVec struct {
+	vec
+}
+
+// WithLabelValues returns the gauge for the given label values
+func (g *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return g.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, m interface{}) {
+		writeSample(w, g.name, labels, m.(*Gauge).Value())
+	})
+}
+
+// Histogram counts observations into configurable buckets
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     value
+}
+
+// Observe adds a single observation to the histogram
+func (h *Histogram) Observe(f float64) {
+	for i, upper := range h.buckets {
+		if f <= upper {
+			atomic.AddUint64(&h.counts[i], 1)
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.Add(f)
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// WithLabelValues returns the histogram for the given label values
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return h.get(values, func() interface{} {
+		return &Histogram{
+			buckets: h.buckets,
+			counts:  make([]uint64, len(h.buckets)),
+		}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, m interface{}) {
+		hist := m.(*Histogram)
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, upper := range hist.buckets {
+			le := prefix + "le=" + quoteLabel(formatFloat(upper))
+			writeSample(w, h.name+"_bucket", le, float64(atomic.LoadUint64(&hist.counts[i])))
+		}
+		count := float64(atomic.LoadUint64(&hist.count))
+		writeSample(w, h.name+"_bucket", prefix+`le="+Inf"`, count)
+		writeSample(w, h.name+"_sum", labels, hist.sum.Get())
+		writeSample(w, h.name+"_count", labels, count)
+	})
+}
@@ -0,0 +1,375 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Critical options and extensions carried through ssh.Permissions,
+// named after those of OpenSSH certificates
+const (
+	OptionForceCommand  = "force-command"
+	OptionSourceAddress = "source-address"
+
+	ExtensionPermitX11Forwarding   = "permit-X11-forwarding"
+	ExtensionPermitAgentForwarding = "permit-agent-forwarding"
+	ExtensionPermitPortForwarding  = "permit-port-forwarding"
+	ExtensionPermitPty             = "permit-pty"
+	ExtensionPermitUserRC          = "permit-user-rc"
+
+	// ExtensionRestricted marks permissions whose permit-* extensions are enforced
+	ExtensionRestricted = "restricted@sshd"
+	// ExtensionPermitOpen lists the allowed direct-tcpip destinations, newline separated
+	ExtensionPermitOpen = "permitopen@sshd"
+	// ExtensionPermitListen lists the allowed tcpip-forward binds, newline separated
+	ExtensionPermitListen = "permitlisten@sshd"
+	// ExtensionEnvironment lists NAME=value environment variables, newline separated
+	ExtensionEnvironment = "environment@sshd"
+	// ExtensionPublicKey records the public key the connection authenticated with, in authorized_keys format
+	ExtensionPublicKey = "publickey@sshd"
+)
+
+// KeyOptions are the options of an authorized_keys line
+type KeyOptions struct {
+	// CertAuthority marks the key as a trusted certificate authority
+	CertAuthority bool
+	// Command is forced instead of any command requested by the client
+	Command string
+	// From is the comma separated list of address patterns the client must connect from
+	From string
+	// PermitOpen lists the host:port destinations allowed for local forwarding
+	PermitOpen []string
+	// PermitListen lists the [host:]port binds allowed for remote forwarding
+	PermitListen []string
+	// Principals is the comma separated list of principals accepted for certificates
+	Principals string
+	// Environment lists the NAME=value variables set for sessions
+	Environment []string
+	// ExpiryTime is the time after which the key is no longer accepted
+	ExpiryTime time.Time
+
+	NoPortForwarding  bool
+	NoPty             bool
+	NoAgentForwarding bool
+	NoX11Forwarding   bool
+	NoUserRC          bool
+}
+
+// ParseKeyOptions parses the options returned by ssh.ParseAuthorizedKey
+func ParseKeyOptions(options []string) (*KeyOptions, error) {
+	o := &KeyOptions{}
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		if hasValue {
+			v, err := unquoteOption(value)
+			if err != nil {
+				return nil, fmt.Errorf("option %s: %w", name, err)
+			}
+			value = v
+		}
+		switch strings.ToLower(name) {
+		case "cert-authority":
+			o.CertAuthority = true
+		case "restrict":
+			o.NoPortForwarding = true
+			o.NoPty = true
+			o.NoAgentForwarding = true
+			o.NoX11Forwarding = true
+			o.NoUserRC = true
+		case "no-port-forwarding":
+			o.NoPortForwarding = true
+		case "port-forwarding":
+			o.NoPortForwarding = false
+		case "no-pty":
+			o.NoPty = true
+		case "pty":
+			o.NoPty = false
+		case "no-agent-forwarding":
+			o.NoAgentForwarding = true
+		case "agent-forwarding":
+			o.NoAgentForwarding = false
+		case "no-x11-forwarding":
+			o.NoX11Forwarding = true
+		case "x11-forwarding":
+			o.NoX11Forwarding = false
+		case "no-user-rc":
+			o.NoUserRC = true
+		case "user-rc":
+			o.NoUserRC = false
+		case "command":
+			o.Command = value
+		case "from":
+			o.From = value
+		case "principals":
+			o.Principals = value
+		case "permitopen":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, fmt.Errorf("option permitopen: %w", err)
+			}
+			o.PermitOpen = append(o.PermitOpen, value)
+		case "permitlisten":
+			o.PermitListen = append(o.PermitListen, value)
+		case "environment":
+			if !strings.Contains(value, "=") {
+				return nil, fmt.Errorf("option environment: invalid %q", value)
+			}
+			o.Environment = append(o.Environment, value)
+		case "expiry-time":
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("option expiry-time: %w", err)
+			}
+			o.ExpiryTime = t
+		default:
+			return nil, fmt.Errorf("unsupported option %q", name)
+		}
+	}
+	return o, nil
+}
+
+func unquoteOption(value string) (string, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", fmt.Errorf("value %s is not quoted", value)
+	}
+	value = value[1 : len(value)-1]
+	return strings.ReplaceAll(value, `\"`, `"`), nil
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]] in local time, or in UTC with a Z suffix
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		loc = time.UTC
+		value = value[:len(value)-1]
+	}
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return time.ParseInLocation(layout, value, loc)
+}
+
+// Check verifies the from= and expiry-time= options for the connection
+func (o *KeyOptions) Check(conn ssh.ConnMetadata) error {
+	if !o.ExpiryTime.IsZero() && time.Now().After(o.ExpiryTime) {
+		return fmt.Errorf("key expired at %s", o.ExpiryTime.Format(time.RFC3339))
+	}
+	if o.From != "" {
+		ip := remoteIP(conn.RemoteAddr())
+		if ip == nil || !MatchAddrList(o.From, ip) {
+			return fmt.Errorf("remote address %s is not allowed by from=%q", conn.RemoteAddr(), o.From)
+		}
+	}
+	return nil
+}
+
+// Permissions returns the options as ssh.Permissions to be enforced after authentication
+func (o *KeyOptions) Permissions() *ssh.Permissions {
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions: map[string]string{
+			ExtensionRestricted: "",
+		},
+	}
+	if o.Command != "" {
+		perms.CriticalOptions[OptionForceCommand] = o.Command
+	}
+	if !o.NoPortForwarding {
+		perms.Extensions[ExtensionPermitPortForwarding] = ""
+	}
+	if !o.NoPty {
+		perms.Extensions[ExtensionPermitPty] = ""
+	}
+	if !o.NoAgentForwarding {
+		perms.Extensions[ExtensionPermitAgentForwarding] = ""
+	}
+	if !o.NoX11Forwarding {
+		perms.Extensions[ExtensionPermitX11Forwarding] = ""
+	}
+	if !o.NoUserRC {
+		perms.Extensions[ExtensionPermitUserRC] = ""
+	}
+	if len(o.PermitOpen) != 0 {
+		perms.Extensions[ExtensionPermitOpen] = strings.Join(o.PermitOpen, "\n")
+	}
+	if len(o.PermitListen) != 0 {
+		perms.Extensions[ExtensionPermitListen] = strings.Join(o.PermitListen, "\n")
+	}
+	if len(o.Environment) != 0 {
+		perms.Extensions[ExtensionEnvironment] = strings.Join(o.Environment, "\n")
+	}
+	return perms
+}
+
+// ExtensionsPermissions returns Permissions enforcing the extensions set by KeyOptions.Permissions,
+// or nil if the permissions are not restricted
+func ExtensionsPermissions(perms *ssh.Permissions) Permissions {
+	if perms == nil {
+		return nil
+	}
+	if _, ok := perms.Extensions[ExtensionRestricted]; !ok {
+		return nil
+	}
+	return extensionsPermissions(perms.Extensions)
+}
+
+type extensionsPermissions map[string]string
+
+func (e extensionsPermissions) has(name string) bool {
+	_, ok := e[name]
+	return ok
+}
+
+func (e extensionsPermissions) list(name string) []string {
+	v, ok := e[name]
+	if !ok {
+		return nil
+	}
+	return strings.Split(v, "\n")
+}
+
+func (e extensionsPermissions) Allow(req string, args string) bool {
+	switch req {
+	case "direct-tcpip":
+		if !e.has(ExtensionPermitPortForwarding) {
+			return false
+		}
+		if permits := e.list(ExtensionPermitOpen); permits != nil {
+			return matchHostPort(permits, args)
+		}
+	case "tcpip-forward":
+		if !e.has(ExtensionPermitPortForwarding) {
+			return false
+		}
+		if permits := e.list(ExtensionPermitListen); permits != nil {
+			return matchHostPort(permits, args)
+		}
+	case "direct-streamlocal", "streamlocal-forward":
+		return e.has(ExtensionPermitPortForwarding)
+	case "session":
+		switch args {
+		case "pty-req":
+			return e.has(ExtensionPermitPty)
+		case "auth-agent-req@openssh.com":
+			return e.has(ExtensionPermitAgentForwarding)
+		case "x11-req":
+			return e.has(ExtensionPermitX11Forwarding)
+		}
+	}
+	return true
+}
+
+// matchHostPort reports whether the host:port matches any of the [host:]port permits,
+// where '*' matches any host or port, an empty host, binding every address,
+// only matches a permit without host or with '*', and "none" matches nothing
+func matchHostPort(permits []string, hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	for _, permit := range permits {
+		if permit == "none" {
+			continue
+		}
+		permitHost, permitPort, err := net.SplitHostPort(permit)
+		if err != nil {
+			permitHost, permitPort = "", permit
+		}
+		if permitPort != "*" && permitPort != port {
+			continue
+		}
+		if permitHost == "" || permitHost == "*" || strings.EqualFold(permitHost, host) {
+			return true
+		}
+		if permitHost == "localhost" && isLoopback(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ForceCommand returns the command forced by the permissions
+func ForceCommand(perms *ssh.Permissions) (string, bool) {
+	if perms == nil {
+		return "", false
+	}
+	cmd, ok := perms.CriticalOptions[OptionForceCommand]
+	return cmd, ok
+}
+
+// Environment returns the NAME=value environment variables set by the permissions
+func Environment(perms *ssh.Permissions) []string {
+	if perms == nil {
+		return nil
+	}
+	env, ok := perms.Extensions[ExtensionEnvironment]
+	if !ok {
+		return nil
+	}
+	return strings.Split(env, "\n")
+}
+
+// PublicKey returns the public key the permissions were granted to
+func PublicKey(perms *ssh.Permissions) (ssh.PublicKey, bool) {
+	if perms == nil {
+		return nil, false
+	}
+	data, ok := perms.Extensions[ExtensionPublicKey]
+	if !ok {
+		return nil, false
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(data))
+	if err != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+// withPublicKey returns a copy of the permissions recording the public key the connection authenticated with,
+// replacing any recorded by the callbacks, or recording none if the key is nil
+func withPublicKey(perms *ssh.Permissions, key ssh.PublicKey) *ssh.Permissions {
+	if key == nil {
+		if perms == nil {
+			return nil
+		}
+		if _, ok := perms.Extensions[ExtensionPublicKey]; !ok {
+			return perms
+		}
+	}
+	p := &ssh.Permissions{
+		Extensions: map[string]string{},
+	}
+	if perms != nil {
+		if perms.CriticalOptions != nil {
+			p.CriticalOptions = map[string]string{}
+			for k, v := range perms.CriticalOptions {
+				p.CriticalOptions[k] = v
+			}
+		}
+		for k, v := range perms.Extensions {
+			p.Extensions[k] = v
+		}
+	}
+	if key == nil {
+		delete(p.Extensions, ExtensionPublicKey)
+	} else {
+		p.Extensions[ExtensionPublicKey] = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	}
+	return p
+}
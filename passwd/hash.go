@@ -0,0 +1,130 @@
+package passwd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrMismatch is returned when the password does not match the hash
+var ErrMismatch = errors.New("password mismatch")
+
+// Scheme is a password hashing scheme
+type Scheme string
+
+const (
+	// Bcrypt hashes in $2y$ format
+	Bcrypt Scheme = "bcrypt"
+	// Argon2id hashes in the $argon2id$ format of the reference implementation
+	Argon2id Scheme = "argon2id"
+	// SHA512Crypt hashes in the $6$ format of crypt(3)
+	SHA512Crypt Scheme = "sha512-crypt"
+)
+
+// Argon2id parameters used by Hash
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Hash hashes the password with the scheme
+// If scheme is empty, then Bcrypt is used
+func Hash(scheme Scheme, password []byte) (string, error) {
+	switch scheme {
+	case Bcrypt, "":
+		hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		// $2a$ and $2y$ are the same, $2y$ is what htpasswd writes
+		return "$2y$" + strings.TrimPrefix(string(hash), "$2a$"), nil
+	case Argon2id:
+		salt := make([]byte, argon2SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey(password, salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	case SHA512Crypt:
+		salt := make([]byte, sha512CryptMaxSalt)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		for i, b := range salt {
+			salt[i] = cryptAlphabet[b&0x3f]
+		}
+		return sha512Crypt(password, salt, 0), nil
+	}
+	return "", fmt.Errorf("unsupported scheme %q", scheme)
+}
+
+// Compare compares the password with the hash in constant time,
+// returning ErrMismatch if they do not match
+func Compare(hash string, password []byte) error {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		// x/crypto/bcrypt does not know the $2y$ prefix, which is otherwise identical
+		err := bcrypt.CompareHashAndPassword([]byte("$2a$"+hash[4:]), password)
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+		return err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return compareArgon2id(hash, password)
+	case strings.HasPrefix(hash, sha512CryptPrefix):
+		return compareSHA512Crypt(hash, password)
+	}
+	return fmt.Errorf("unsupported hash")
+}
+
+// compareArgon2id compares the password with a $argon2id$ hash in constant time
+func compareArgon2id(hash string, password []byte) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	if time == 0 || threads == 0 {
+		return fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return fmt.Errorf("invalid argon2id key: %w", err)
+	}
+	got := argon2.IDKey(password, salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package passwd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Test vectors from the SHA-crypt specification of glibc
+func TestSHA512Crypt(t *testing.T) {
+	tests := []struct {
+		salt     string
+		rounds   int
+		password string
+		want     string
+	}{
+		{"saltstring", 0, "Hello world!",
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"saltstringsaltstring", 10000, "Hello world!",
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"toolongsaltstring", 5000, "This is just a test",
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"anotherlongsaltstring", 1400, "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+			"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+		{"short", 77777, "we have a short salt string but not a short password",
+			"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+		{"asaltof16chars..", 123456, "a short string",
+			"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+		{"roundstoolow", 10, "the minimum number is still observed",
+			"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.salt, func(t *testing.T) {
+			got := sha512Crypt([]byte(tt.password), []byte(tt.salt), tt.rounds)
+			if got != tt.want {
+				t.Errorf("sha512Crypt() = %q, want %q", got, tt.want)
+			}
+			if err := Compare(tt.want, []byte(tt.password)); err != nil {
+				t.Errorf("Compare() = %v", err)
+			}
+			if err := Compare(tt.want, []byte(tt.password+"x")); !errors.Is(err, ErrMismatch) {
+				t.Errorf("Compare() of wrong password = %v, want ErrMismatch", err)
+			}
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	tests := []struct {
+		scheme Scheme
+		prefix string
+	}{
+		{"", "$2y$"},
+		{Bcrypt, "$2y$"},
+		{Argon2id, "$argon2id$"},
+		{SHA512Crypt, "$6$"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.scheme), func(t *testing.T) {
+			hash, err := Hash(tt.scheme, []byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hash, tt.prefix) {
+				t.Errorf("Hash() = %q, want prefix %q", hash, tt.prefix)
+			}
+			if err := Compare(hash, []byte("secret")); err != nil {
+				t.Errorf("Compare() = %v", err)
+			}
+			if err := Compare(hash, []byte("wrong")); !errors.Is(err, ErrMismatch) {
+				t.Errorf("Compare() of wrong password = %v, want ErrMismatch", err)
+			}
+		})
+	}
+}
+
+func TestCompareBcryptPrefixes(t *testing.T) {
+	hash, err := Hash(Bcrypt, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if err := Compare(prefix+hash[4:], []byte("secret")); err != nil {
+			t.Errorf("Compare() of %s = %v", prefix, err)
+		}
+	}
+}
+
+func TestCompareInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"plain",
+		"$1$salt$hash",
+		"$6$rounds=x$salt$hash",
+		"$6$nohash",
+		"$argon2id$v=19$m=65536,t=3,p=4$salt",
+		"$argon2id$v=18$m=65536,t=3,p=4$c2FsdA$a2V5",
+	}
+	for _, hash := range tests {
+		err := Compare(hash, []byte("secret"))
+		if err == nil || errors.Is(err, ErrMismatch) {
+			t.Errorf("Compare(%q) = %v, want an invalid hash error", hash, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package passwd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Passwords is a password database of users and their password hashes in htpasswd format
+type Passwords struct {
+	// Data is the password hash by username
+	Data map[string]string
+}
+
+// Allow reports whether the password matches the hash of the user
+func (p *Passwords) Allow(user string, password []byte) bool {
+	hash, ok := p.Data[user]
+	if !ok {
+		// Compare anyway so unknown users take as long as known ones
+		Compare(dummyHash(), password)
+		return false
+	}
+	return Compare(hash, password) == nil
+}
+
+// PasswordCallback authenticates the user by the password,
+// it can be used as ssh.ServerConfig.PasswordCallback
+func (p *Passwords) PasswordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if !p.Allow(conn.User(), password) {
+		return nil, fmt.Errorf("password rejected for %q", conn.User())
+	}
+	return nil, nil
+}
+
+var (
+	dummyOnce sync.Once
+	dummy     string
+)
+
+func dummyHash() string {
+	dummyOnce.Do(func() {
+		dummy, _ = Hash(Bcrypt, []byte("dummy"))
+	})
+	return dummy
+}
+
+// GetPasswordsFile reads the password database of a file in htpasswd format
+func GetPasswordsFile(file string) (*Passwords, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParsePasswords(f)
+}
+
+// ParsePasswords parses user:hash lines, ignoring empty lines and lines starting with '#'
+func ParsePasswords(r io.Reader) (*Passwords, error) {
+	data := map[string]string{}
+	read := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := read.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if text := strings.TrimSpace(line); text != "" && !strings.HasPrefix(text, "#") {
+			user, hash, ok := strings.Cut(text, ":")
+			if !ok || user == "" || hash == "" {
+				return nil, fmt.Errorf("line %d: expected user:hash", n)
+			}
+			data[user] = hash
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return &Passwords{data}, nil
+}
+
+// File is a password file that can be reloaded atomically
+type File struct {
+	path      string
+	passwords atomic.Pointer[Passwords]
+}
+
+// NewFile loads the password file
+func NewFile(path string) (*File, error) {
+	f := &File{path: path}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again, keeping the previous passwords if it fails
+func (f *File) Reload() error {
+	p, err := GetPasswordsFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.passwords.Store(p)
+	return nil
+}
+
+// PasswordCallback authenticates the user with the passwords currently loaded,
+// it can be used as ssh.ServerConfig.PasswordCallback
+func (f *File) PasswordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	return f.passwords.Load().PasswordCallback(conn, password)
+}
@@ -0,0 +1,165 @@
+package passwd
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	sha512CryptPrefix        = "$6$"
+	sha512CryptRoundsPrefix  = "rounds="
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSalt       = 16
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512CryptOrder is the byte order of the digest in the encoded hash
+var sha512CryptOrder = [...][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// sha512Crypt returns the SHA-512 crypt hash of the password in $6$[rounds=N$]salt$hash format
+// If rounds is zero, then the default of 5000 is used and omitted from the hash
+func sha512Crypt(password, salt []byte, rounds int) string {
+	explicit := rounds != 0
+	if !explicit {
+		rounds = sha512CryptDefaultRounds
+	}
+	if rounds < sha512CryptMinRounds {
+		rounds = sha512CryptMinRounds
+	} else if rounds > sha512CryptMaxRounds {
+		rounds = sha512CryptMaxRounds
+	}
+	if len(salt) > sha512CryptMaxSalt {
+		salt = salt[:sha512CryptMaxSalt]
+	}
+
+	h := sha512.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeat(b, len(password)))
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range password {
+		h.Write(password)
+	}
+	p := repeat(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeat(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512CryptPrefix)
+	if explicit {
+		out.WriteString(sha512CryptRoundsPrefix)
+		out.WriteString(strconv.Itoa(rounds))
+		out.WriteByte('$')
+	}
+	out.Write(salt)
+	out.WriteByte('$')
+	for _, o := range sha512CryptOrder {
+		encodeCrypt(&out, uint(c[o[0]])<<16|uint(c[o[1]])<<8|uint(c[o[2]]), 4)
+	}
+	encodeCrypt(&out, uint(c[63]), 2)
+	return out.String()
+}
+
+// compareSHA512Crypt compares the password with a $6$ hash in constant time
+func compareSHA512Crypt(hash string, password []byte) error {
+	salt, rounds, err := parseSHA512Crypt(hash)
+	if err != nil {
+		return err
+	}
+	got := sha512Crypt(password, []byte(salt), rounds)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(hash)) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func parseSHA512Crypt(hash string) (salt string, rounds int, err error) {
+	rest, ok := strings.CutPrefix(hash, sha512CryptPrefix)
+	if !ok {
+		return "", 0, fmt.Errorf("not a sha512-crypt hash")
+	}
+	if r, ok := strings.CutPrefix(rest, sha512CryptRoundsPrefix); ok {
+		n, after, ok := strings.Cut(r, "$")
+		if !ok {
+			return "", 0, fmt.Errorf("invalid sha512-crypt hash")
+		}
+		rounds, err = strconv.Atoi(n)
+		if err != nil || rounds <= 0 {
+			return "", 0, fmt.Errorf("invalid sha512-crypt rounds %q", n)
+		}
+		rest = after
+	}
+	salt, _, ok = strings.Cut(rest, "$")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid sha512-crypt hash")
+	}
+	return salt, rounds, nil
+}
+
+func repeat(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+func encodeCrypt(out *strings.Builder, v uint, n int) {
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+}
@@ -1,6 +1,65 @@
 package sshd
 
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
 // Permissions specifies the permissions that the user has
 type Permissions interface {
 	Allow(req string, args string) bool
 }
+
+// housekeepingRequests are the session requests that only keep a session going
+var housekeepingRequests = map[string]bool{
+	"window-change":         true,
+	"signal":                true,
+	"keepalive@openssh.com": true,
+}
+
+// IsHousekeeping reports whether the session request only keeps the session going,
+// such as window-change, and grants nothing by itself
+func IsHousekeeping(req string) bool {
+	return housekeepingRequests[req]
+}
+
+// JoinPermissions returns Permissions that allow only what all the non-nil permissions allow
+// If all are nil, then nil
+func JoinPermissions(perms ...Permissions) Permissions {
+	var joined joinPermissions
+	for _, p := range perms {
+		if p != nil {
+			joined = append(joined, p)
+		}
+	}
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
+
+type joinPermissions []Permissions
+
+func (j joinPermissions) Allow(req string, args string) bool {
+	for _, p := range j {
+		if !p.Allow(req, args) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authorize asks each of the permissions in turn, giving the reason of the first denial
+func (j joinPermissions) Authorize(ctx context.Context, conn ssh.ConnMetadata, req *AuthorizeRequest) Decision {
+	for _, p := range j {
+		decision := PermissionsAuthorizer(p).Authorize(ctx, conn, req)
+		if !decision.Allow {
+			return decision
+		}
+	}
+	return Decision{Allow: true}
+}
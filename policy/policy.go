@@ -0,0 +1,448 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/wzshiming/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// Action is what a rule does with the requests it matches
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Policy decides the channels and requests of connections by rules, the first matching rule applies
+type Policy struct {
+	// Rules are matched in order
+	Rules []Rule `json:"rules"`
+	// Default is the action when no rule matches
+	// If empty, then deny
+	Default Action `json:"default,omitempty"`
+	// Groups returns the groups of the user
+	// If nil, then the groups of the system user are used
+	Groups func(user string) ([]string, error) `json:"-"`
+}
+
+// Rule matches connections by who they are and requests by what they ask for,
+// all the non-empty fields must match and any entry of a field matches it
+//
+// Users, Groups and Requests are patterns where '*' matches any sequence and '?' any character,
+// From and Hosts also take CIDRs, and an entry prefixed with '!' fails the field when matched,
+// so a field also needs entries without '!' to match anything
+type Rule struct {
+	// Name identifies the rule in logs
+	Name string `json:"name,omitempty"`
+	// Action is allow or deny
+	Action Action `json:"action"`
+
+	// Users are the usernames
+	Users []string `json:"users,omitempty"`
+	// Groups are the groups of the user
+	Groups []string `json:"groups,omitempty"`
+	// Keys are the SHA256 fingerprints of the public key the connection authenticated with,
+	// or of the authority that signed its certificate
+	Keys []string `json:"keys,omitempty"`
+	// From are the addresses of the client
+	From []string `json:"from,omitempty"`
+
+	// Requests are the channel and global request types, such as session, direct-tcpip,
+	// tcpip-forward, direct-streamlocal and streamlocal-forward
+	Requests []string `json:"requests,omitempty"`
+	// Session are the requests of session channels, such as pty-req, env, shell, exec and subsystem,
+	// a rule with them does not match opening the channel itself
+	// The housekeeping requests window-change, signal and keepalive@openssh.com
+	// are allowed when no rule matches them, whatever the default
+	Session []string `json:"session,omitempty"`
+	// Hosts are the destinations of direct-tcpip and the bind addresses of tcpip-forward,
+	// where binding any address is the empty host
+	//
+	// Hosts are matched literally against what the client asks for, hostnames are not resolved,
+	// so a CIDR only matches IP addresses and a hostname resolving into it would bypass it,
+	// which is why CIDRs are only accepted in allow rules and not negated
+	Hosts []string `json:"hosts,omitempty"`
+	// Ports are the ports of direct-tcpip and tcpip-forward, as numbers, ranges like 8000-8999 or *
+	Ports []string `json:"ports,omitempty"`
+	// Paths are prefixes of the socket paths of direct-streamlocal and streamlocal-forward,
+	// matching the path itself and the paths under it
+	Paths []string `json:"paths,omitempty"`
+}
+
+// GetPolicyFile reads the policy of a JSON file
+func GetPolicyFile(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses and validates a policy in JSON
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	err = p.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks the actions, ports, CIDRs and negations of the rules,
+// and that no rule relies on a CIDR of Hosts to keep out a destination
+func (p *Policy) Validate() error {
+	switch p.Default {
+	case "", Allow, Deny:
+	default:
+		return fmt.Errorf("default: unknown action %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		err := rule.validate()
+		if err != nil {
+			if rule.Name != "" {
+				return fmt.Errorf("rule %d (%s): %w", i+1, rule.Name, err)
+			}
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) validate() error {
+	switch r.Action {
+	case Allow, Deny:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	fields := []struct {
+		name    string
+		entries []string
+	}{
+		{"users", r.Users}, {"groups", r.Groups}, {"from", r.From},
+		{"requests", r.Requests}, {"session", r.Session}, {"hosts", r.Hosts},
+	}
+	for _, field := range fields {
+		if onlyNegations(field.entries) {
+			return fmt.Errorf("%s: only negations never match, add \"*\" to match everything else", field.name)
+		}
+	}
+	for _, port := range r.Ports {
+		_, _, err := parsePortRange(port)
+		if err != nil {
+			return err
+		}
+	}
+	for _, addrs := range [][]string{r.From, r.Hosts} {
+		for _, addr := range addrs {
+			addr = strings.TrimPrefix(addr, "!")
+			if strings.Contains(addr, "/") {
+				_, _, err := net.ParseCIDR(addr)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, h := range r.Hosts {
+		if strings.Contains(h, "/") && (r.Action == Deny || strings.HasPrefix(h, "!")) {
+			return fmt.Errorf("host %q: a CIDR can not exclude hostnames, which are not resolved", h)
+		}
+	}
+	for _, prefix := range r.Paths {
+		if prefix == "" {
+			return fmt.Errorf("empty path prefix")
+		}
+	}
+	return nil
+}
+
+func onlyNegations(entries []string) bool {
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry, "!") {
+			return false
+		}
+	}
+	return len(entries) != 0
+}
+
+// Permissions returns the permissions of the connection, made of the rules matching it
+func (p *Policy) Permissions(conn *sshd.ServerConn) sshd.Permissions {
+	perms := &connPermissions{
+		policy: p,
+	}
+	var groups []string
+	var groupsErr error
+	groupsLoaded := false
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.Groups) != 0 && !groupsLoaded {
+			groups, groupsErr = p.groups(conn.User())
+			groupsLoaded = true
+			if groupsErr != nil && conn.Logger != nil {
+				conn.Logger.Println("unable to get the groups of", conn.User(), groupsErr)
+			}
+		}
+		if rule.matchConn(conn, groups) {
+			perms.rules = append(perms.rules, rule)
+			perms.index = append(perms.index, i)
+		}
+	}
+	return perms
+}
+
+func (p *Policy) groups(name string) ([]string, error) {
+	if p.Groups != nil {
+		return p.Groups(name)
+	}
+	return sshd.UserGroups(name)
+}
+
+// connPermissions are the rules of the policy matching a connection
+type connPermissions struct {
+	policy *Policy
+	rules  []*Rule
+	// index is the position of each rule in the policy
+	index []int
+}
+
+func (c *connPermissions) Allow(req string, args string) bool {
+	return c.decide(req, args).Allow
+}
+
+// Authorize gives the rule that decided as the reason
+func (c *connPermissions) Authorize(ctx context.Context, conn ssh.ConnMetadata, req *sshd.AuthorizeRequest) sshd.Decision {
+	return c.decide(req.Type, req.Args)
+}
+
+func (c *connPermissions) decide(req string, args string) sshd.Decision {
+	for i, rule := range c.rules {
+		if rule.matchRequest(req, args) {
+			name := rule.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", c.index[i]+1)
+			}
+			return sshd.Decision{
+				Allow:  rule.Action == Allow,
+				Reason: fmt.Sprintf("%s by policy rule %s", rule.Action.past(), name),
+			}
+		}
+	}
+	if c.policy.Default == Allow {
+		return sshd.Decision{Allow: true, Reason: "allowed by policy default"}
+	}
+	if req == "session" && sshd.IsHousekeeping(args) {
+		return sshd.Decision{Allow: true, Reason: "allowed as session housekeeping"}
+	}
+	return sshd.Decision{Allow: false, Reason: "denied by policy default"}
+}
+
+func (a Action) past() string {
+	if a == Allow {
+		return "allowed"
+	}
+	return "denied"
+}
+
+func (r *Rule) matchConn(conn *sshd.ServerConn, groups []string) bool {
+	if len(r.Users) != 0 && !sshd.MatchPatternList(strings.Join(r.Users, ","), conn.User()) {
+		return false
+	}
+	if len(r.Groups) != 0 {
+		patterns := strings.Join(r.Groups, ",")
+		matched := false
+		for _, group := range groups {
+			if sshd.MatchPatternList(patterns, group) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Keys) != 0 && !matchKey(r.Keys, conn.PublicKey) {
+		return false
+	}
+	if len(r.From) != 0 {
+		ip := net.ParseIP(host(conn.RemoteAddr().String()))
+		if ip == nil || !sshd.MatchAddrList(strings.Join(r.From, ","), ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) matchRequest(req string, args string) bool {
+	if len(r.Requests) != 0 && !sshd.MatchPatternList(strings.Join(r.Requests, ","), req) {
+		return false
+	}
+	switch req {
+	case "session":
+		if len(r.Hosts) != 0 || len(r.Ports) != 0 || len(r.Paths) != 0 {
+			return false
+		}
+		if len(r.Session) != 0 && !sshd.MatchPatternList(strings.Join(r.Session, ","), args) {
+			return false
+		}
+	case "direct-tcpip", "tcpip-forward":
+		if len(r.Session) != 0 || len(r.Paths) != 0 {
+			return false
+		}
+		h, p, err := net.SplitHostPort(args)
+		if err != nil {
+			return false
+		}
+		if len(r.Hosts) != 0 && !matchHost(r.Hosts, h) {
+			return false
+		}
+		if len(r.Ports) != 0 && !matchPort(r.Ports, p) {
+			return false
+		}
+	case "direct-streamlocal", "streamlocal-forward":
+		if len(r.Session) != 0 || len(r.Hosts) != 0 || len(r.Ports) != 0 {
+			return false
+		}
+		if len(r.Paths) != 0 && !matchPath(r.Paths, args) {
+			return false
+		}
+	default:
+		if len(r.Session) != 0 || len(r.Hosts) != 0 || len(r.Ports) != 0 || len(r.Paths) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func matchKey(fingerprints []string, key ssh.PublicKey) bool {
+	if key == nil {
+		return false
+	}
+	keys := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		keys = []ssh.PublicKey{cert.Key, cert.SignatureKey}
+	}
+	for _, k := range keys {
+		fingerprint := ssh.FingerprintSHA256(k)
+		for _, f := range fingerprints {
+			if f == fingerprint {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchHost(patterns []string, h string) bool {
+	if ip := net.ParseIP(h); ip != nil {
+		return sshd.MatchAddrList(strings.Join(patterns, ","), ip)
+	}
+	return sshd.MatchPatternList(strings.ToLower(strings.Join(patterns, ",")), strings.ToLower(h))
+}
+
+func matchPort(ranges []string, p string) bool {
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		low, high, err := parsePortRange(r)
+		if err != nil {
+			continue
+		}
+		if uint64(low) <= port && port <= uint64(high) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRange parses a port, a range of ports like 8000-8999, or * for any
+func parsePortRange(s string) (uint16, uint16, error) {
+	if s == "*" {
+		return 0, 65535, nil
+	}
+	lowText, highText, isRange := strings.Cut(s, "-")
+	low, err := strconv.ParseUint(lowText, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return uint16(low), uint16(low), nil
+	}
+	high, err := strconv.ParseUint(highText, 10, 16)
+	if err != nil || high < low {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(low), uint16(high), nil
+}
+
+func matchPath(prefixes []string, p string) bool {
+	if p == "" {
+		return false
+	}
+	p = path.Clean(p)
+	for _, prefix := range prefixes {
+		prefix = path.Clean(prefix)
+		if p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func host(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return h
+}
+
+// File is a policy file that can be reloaded atomically
+type File struct {
+	path   string
+	policy atomic.Pointer[Policy]
+}
+
+// NewFile loads the policy file
+func NewFile(path string) (*File, error) {
+	f := &File{path: path}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again, keeping the previous policy if it fails
+func (f *File) Reload() error {
+	p, err := GetPolicyFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.policy.Store(p)
+	return nil
+}
+
+// Permissions returns the permissions of the connection by the policy currently loaded,
+// it can be used as sshd.Server.ConnPermissions
+func (f *File) Permissions(conn *sshd.ServerConn) sshd.Permissions {
+	return f.policy.Load().Permissions(conn)
+}
@@ -0,0 +1,166 @@
+package policy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/wzshiming/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+type testConn struct {
+	ssh.Conn
+	user string
+	addr net.Addr
+}
+
+func (c *testConn) User() string         { return c.user }
+func (c *testConn) RemoteAddr() net.Addr { return c.addr }
+
+func newTestConn(user, ip string) *sshd.ServerConn {
+	return &sshd.ServerConn{
+		ServerConn: &ssh.ServerConn{
+			Conn: &testConn{user: user, addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}},
+		},
+	}
+}
+
+const testPolicy = `{
+	"rules": [
+		{"name": "web", "action": "allow", "users": ["alice"], "requests": ["direct-tcpip"], "hosts": ["example.com"], "ports": ["80", "443"]},
+		{"action": "deny", "users": ["alice"], "requests": ["direct-tcpip"]},
+		{"name": "lan", "action": "allow", "requests": ["direct-tcpip"], "hosts": ["10.0.0.0/8"], "ports": ["8000-8999"]},
+		{"name": "admins", "action": "allow", "users": ["*", "!root"], "from": ["192.168.0.0/16", "!192.168.1.1"], "requests": ["tcpip-forward"], "hosts": ["", "localhost"], "ports": ["*"]},
+		{"name": "no-pty", "action": "deny", "users": ["bob"], "session": ["pty-req"]},
+		{"name": "commands", "action": "allow", "session": ["shell", "exec", "pty-req"]},
+		{"name": "sessions", "action": "allow", "users": ["alice"], "requests": ["session"]},
+		{"name": "sockets", "action": "allow", "requests": ["streamlocal-forward"], "paths": ["/tmp/sockets/"]}
+	]
+}`
+
+func TestPolicyDecide(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, from string
+		req, args  string
+		allow      bool
+		reason     string
+	}{
+		{"alice", "192.168.0.2", "direct-tcpip", "example.com:443", true, "allowed by policy rule web"},
+		{"alice", "192.168.0.2", "direct-tcpip", "EXAMPLE.com:80", true, "allowed by policy rule web"},
+		{"alice", "192.168.0.2", "direct-tcpip", "example.com:22", false, "denied by policy rule #2"},
+		{"alice", "192.168.0.2", "direct-tcpip", "10.1.2.3:8080", false, "denied by policy rule #2"},
+		{"bob", "192.168.0.2", "direct-tcpip", "10.1.2.3:8080", true, "allowed by policy rule lan"},
+		{"bob", "192.168.0.2", "direct-tcpip", "10.1.2.3:9000", false, "denied by policy default"},
+		{"bob", "192.168.0.2", "direct-tcpip", "intranet:8080", false, "denied by policy default"},
+		{"bob", "192.168.0.2", "tcpip-forward", ":2222", true, "allowed by policy rule admins"},
+		{"bob", "192.168.0.2", "tcpip-forward", "localhost:2222", true, "allowed by policy rule admins"},
+		{"bob", "192.168.0.2", "tcpip-forward", "0.0.0.0:2222", false, "denied by policy default"},
+		{"bob", "192.168.1.1", "tcpip-forward", ":2222", false, "denied by policy default"},
+		{"bob", "10.0.0.1", "tcpip-forward", ":2222", false, "denied by policy default"},
+		{"root", "192.168.0.2", "tcpip-forward", ":2222", false, "denied by policy default"},
+		{"alice", "10.0.0.1", "session", "", true, "allowed by policy rule sessions"},
+		{"bob", "10.0.0.1", "session", "", false, "denied by policy default"},
+		{"bob", "10.0.0.1", "session", "pty-req", false, "denied by policy rule no-pty"},
+		{"alice", "10.0.0.1", "session", "pty-req", true, "allowed by policy rule commands"},
+		{"bob", "10.0.0.1", "session", "exec", true, "allowed by policy rule commands"},
+		{"bob", "10.0.0.1", "session", "env", false, "denied by policy default"},
+		{"alice", "10.0.0.1", "session", "env", true, "allowed by policy rule sessions"},
+		{"bob", "10.0.0.1", "session", "window-change", true, "allowed as session housekeeping"},
+		{"bob", "10.0.0.1", "session", "keepalive@openssh.com", true, "allowed as session housekeeping"},
+		{"bob", "10.0.0.1", "streamlocal-forward", "/tmp/sockets/a.sock", true, "allowed by policy rule sockets"},
+		{"bob", "10.0.0.1", "streamlocal-forward", "/tmp/sockets/../b.sock", false, "denied by policy default"},
+		{"bob", "10.0.0.1", "streamlocal-forward", "/tmp/socketsx", false, "denied by policy default"},
+		{"bob", "10.0.0.1", "direct-streamlocal", "/tmp/sockets/a.sock", false, "denied by policy default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+" "+tt.req+" "+tt.args, func(t *testing.T) {
+			perms := p.Permissions(newTestConn(tt.user, tt.from)).(*connPermissions)
+			got := perms.decide(tt.req, tt.args)
+			if got.Allow != tt.allow || got.Reason != tt.reason {
+				t.Errorf("decide() = %v %q, want %v %q", got.Allow, got.Reason, tt.allow, tt.reason)
+			}
+			if perms.Allow(tt.req, tt.args) != tt.allow {
+				t.Errorf("Allow() = %v, want %v", !tt.allow, tt.allow)
+			}
+		})
+	}
+}
+
+func TestPolicyDefaultAllow(t *testing.T) {
+	p, err := ParsePolicy([]byte(`{"rules": [{"action": "deny", "requests": ["tcpip-forward"], "ports": ["1-1023"]}], "default": "allow"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms := p.Permissions(newTestConn("alice", "10.0.0.1"))
+	tests := []struct {
+		req, args string
+		allow     bool
+	}{
+		{"tcpip-forward", ":22", false},
+		{"tcpip-forward", ":1023", false},
+		{"tcpip-forward", ":1024", true},
+		{"direct-tcpip", "example.com:22", true},
+		{"session", "pty-req", true},
+	}
+	for _, tt := range tests {
+		if got := perms.Allow(tt.req, tt.args); got != tt.allow {
+			t.Errorf("Allow(%q, %q) = %v, want %v", tt.req, tt.args, got, tt.allow)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy string
+		valid  bool
+	}{
+		{`{"rules": [{"action": "allow", "hosts": ["10.0.0.0/8", "*.example.com"]}]}`, true},
+		{`{"rules": [{"action": "deny", "hosts": ["*", "!localhost"], "from": ["*", "!10.0.0.0/8"]}]}`, true},
+		{`{"rules": [{"action": "deny", "hosts": ["!localhost"]}]}`, false},
+		{`{"rules": [{"action": "deny", "from": ["!10.0.0.0/8"]}]}`, false},
+		{`{"rules": [{"action": "allow", "users": ["!root"]}]}`, false},
+		{`{"rules": [], "default": "maybe"}`, false},
+		{`{"rules": [{"action": "permit"}]}`, false},
+		{`{"rules": [{"action": "allow", "unknown": true}]}`, false},
+		{`{"rules": [{"action": "allow", "ports": ["22-"]}]}`, false},
+		{`{"rules": [{"action": "allow", "ports": ["99999"]}]}`, false},
+		{`{"rules": [{"action": "allow", "ports": ["9000-8000"]}]}`, false},
+		{`{"rules": [{"action": "allow", "from": ["10.0.0.0/33"]}]}`, false},
+		{`{"rules": [{"action": "deny", "hosts": ["10.0.0.0/8"]}]}`, false},
+		{`{"rules": [{"action": "deny", "hosts": ["!10.0.0.0/8"]}]}`, false},
+		{`{"rules": [{"action": "allow", "hosts": ["*", "!10.0.0.0/8"]}]}`, false},
+		{`{"rules": [{"action": "allow", "paths": [""]}]}`, false},
+	}
+	for _, tt := range tests {
+		_, err := ParsePolicy([]byte(tt.policy))
+		if (err == nil) != tt.valid {
+			t.Errorf("ParsePolicy(%s) = %v, want valid %v", tt.policy, err, tt.valid)
+		}
+	}
+}
+
+func TestPolicyDenyExcept(t *testing.T) {
+	p, err := ParsePolicy([]byte(`{"rules": [{"action": "deny", "requests": ["direct-tcpip"], "hosts": ["*", "!localhost", "!127.0.0.1"]}], "default": "allow"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms := p.Permissions(newTestConn("alice", "10.0.0.1"))
+	tests := []struct {
+		args  string
+		allow bool
+	}{
+		{"localhost:22", true},
+		{"127.0.0.1:22", true},
+		{"127.0.0.2:22", false},
+		{"example.com:22", false},
+	}
+	for _, tt := range tests {
+		if got := perms.Allow("direct-tcpip", tt.args); got != tt.allow {
+			t.Errorf("Allow(%q) = %v, want %v", tt.args, got, tt.allow)
+		}
+	}
+}
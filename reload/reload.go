@@ -0,0 +1,156 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/sshd"
+)
+
+// Group reloads a set of sources together, such as authorized keys, host keys and passwords
+// Each source swaps its state atomically and keeps the previous one if it fails to reload,
+// so existing connections are not disturbed
+type Group struct {
+	// Logger error log
+	Logger sshd.Logger
+
+	mut     sync.Mutex
+	sources []source
+}
+
+type source struct {
+	name   string
+	reload func() error
+}
+
+// Add adds the source to the group
+func (g *Group) Add(name string, reload func() error) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.sources = append(g.sources, source{name, reload})
+}
+
+// Reload reloads all the sources, it returns the errors of those that failed
+func (g *Group) Reload() error {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	var errs []error
+	for _, s := range g.sources {
+		err := s.reload()
+		if err != nil {
+			err = fmt.Errorf("reload %s: %w", s.name, err)
+			if g.Logger != nil {
+				g.Logger.Println(err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 && g.Logger != nil {
+		g.Logger.Println("reloaded", len(g.sources), "sources")
+	}
+	return errors.Join(errs...)
+}
+
+// NotifySignal reloads the group whenever one of the signals is received, until the context is done
+func (g *Group) NotifySignal(ctx context.Context, sig ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			g.Reload()
+		}
+	}
+}
+
+// debounce is how long to wait for further changes before reloading
+const debounce = 200 * time.Millisecond
+
+// pollInterval is how often the files are checked when they can not be watched
+const pollInterval = 2 * time.Second
+
+// Watch reloads the group whenever one of the files changes, until the context is done
+// Files are watched with inotify on Linux, and polled otherwise
+func (g *Group) Watch(ctx context.Context, files ...string) error {
+	changes := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	err := watch(ctx, files, notify)
+	if err != nil {
+		if g.Logger != nil {
+			g.Logger.Println("watching files failed, polling instead:", err)
+		}
+		go poll(ctx, files, notify)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changes:
+		}
+		// Wait for the writes to settle
+		timer := time.NewTimer(debounce)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		select {
+		case <-changes:
+		default:
+		}
+		g.Reload()
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func statFile(file string) fileState {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{info.ModTime(), info.Size(), true}
+}
+
+// poll checks the files for changes every pollInterval
+func poll(ctx context.Context, files []string, notify func()) {
+	states := make([]fileState, len(files))
+	for i, file := range files {
+		states[i] = statFile(file)
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for i, file := range files {
+			state := statFile(file)
+			if state != states[i] {
+				states[i] = state
+				notify()
+			}
+		}
+	}
+}
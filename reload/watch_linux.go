@@ -0,0 +1,71 @@
+//go:build linux
+
+package reload
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watch watches the directories of the files with inotify, so files replaced by rename are noticed
+func watch(ctx context.Context, files []string, notify func()) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// A non-blocking file is read through the runtime poller, so closing it stops the reads
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+		unix.IN_CREATE | unix.IN_DELETE | unix.IN_ATTRIB
+	names := map[int]map[string]bool{}
+	for _, file := range files {
+		dir, name := filepath.Split(filepath.Clean(file))
+		if dir == "" {
+			dir = "."
+		}
+		wd, err := unix.InotifyAddWatch(fd, dir, mask)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if names[wd] == nil {
+			names[wd] = map[string]bool{}
+		}
+		names[wd][name] = true
+	}
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + unix.SizeofInotifyEvent
+				nameEnd := nameStart + int(event.Len)
+				if nameEnd > n {
+					break
+				}
+				name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+				// Kubernetes style mounts swap a ..data symlink rather than the files
+				if names[int(event.Wd)][name] || name == "..data" || event.Mask&unix.IN_Q_OVERFLOW != 0 {
+					notify()
+				}
+				offset = nameEnd
+			}
+		}
+	}()
+	return nil
+}
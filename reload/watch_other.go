@@ -0,0 +1,13 @@
+//go:build !linux
+
+package reload
+
+import (
+	"context"
+	"errors"
+)
+
+// watch is not supported on this platform, the files are polled instead
+func watch(ctx context.Context, files []string, notify func()) error {
+	return errors.New("file notifications not supported")
+}
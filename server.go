@@ -6,10 +6,18 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -31,12 +39,55 @@ type Server struct {
 	// UserPermissions are based on the user getting all their permissions
 	// If nil, then allow all
 	UserPermissions func(user string) Permissions
+	// ConnPermissions are based on the authenticated connection getting all their permissions,
+	// restricting those of UserPermissions
+	// If nil, then allow all
+	ConnPermissions func(conn *ServerConn) Permissions
+	// Authorizer decides the channels and requests the permissions allow
+	// If nil, then the permissions decide alone
+	Authorizer Authorizer
+	// Audit records the authentication attempts and authorization decisions
+	// If nil, then nothing is recorded
+	Audit AuditSink
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool BytesPool
 	// Default environment
 	Environ []string
 	// Default workdir
 	Dir string
+	// Metrics records statistics of the server
+	// If nil, then nothing is recorded
+	Metrics *Metrics
+	// MaxConnections limits the number of concurrent connections
+	// If zero, then unlimited
+	MaxConnections int
+	// MaxConnectionsPerIP limits the number of concurrent connections from a single IP
+	// If zero, then unlimited
+	MaxConnectionsPerIP int
+	// MaxStartups randomly drops new connections while too many are unauthenticated
+	MaxStartups MaxStartups
+	// HandshakeTimeout is the maximum time for the handshake and authentication,
+	// after which the connection is closed
+	// If zero, then no timeout
+	HandshakeTimeout time.Duration
+	// Guard refuses connections and delays authentication of brute-force attackers
+	// If nil, then nothing is refused
+	Guard Guard
+	// RevocationList refuses revoked keys and certificates during public key authentication
+	// If nil, then nothing is refused
+	RevocationList RevocationList
+	// Motd returns the message shown to interactive sessions of the connection
+	// If nil, then nothing is shown
+	Motd func(conn *ServerConn) string
+
+	mut        sync.Mutex
+	conns      map[string]*ServerConn
+	lastConnID uint64
+	serving    int32
+	connCount  int
+	connsPerIP map[string]int
+	startups   int
+	hostKeys   atomic.Pointer[[]ssh.Signer]
 }
 
 func NewServer() *Server {
@@ -75,6 +126,8 @@ func (s *Server) proxyListen(ctx context.Context, network, address string) (net.
 
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	atomic.AddInt32(&s.serving, 1)
+	defer atomic.AddInt32(&s.serving, -1)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -84,29 +137,341 @@ func (s *Server) Serve(l net.Listener) error {
 	}
 }
 
+// Ready reports whether the server is accepting connections
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.serving) > 0
+}
+
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) {
-	c, err := NewServerConn(conn, &s.ServerConfig)
+	if s.Guard != nil && !s.Guard.AllowConn(conn.RemoteAddr()) {
+		conn.Close()
+		s.Metrics.ConnectionRejected()
+		if s.Logger != nil {
+			s.Logger.Println("refused connection from", conn.RemoteAddr(), "banned")
+		}
+		return
+	}
+
+	slot, err := s.acquireConn(conn.RemoteAddr())
+	if err != nil {
+		conn.Close()
+		s.Metrics.ConnectionRejected()
+		if s.Logger != nil {
+			s.Logger.Println("refused connection from", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	defer slot.release()
+
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	var auth connAuth
+	c, err := NewServerConn(conn, s.serverConfig(&auth))
 	if err != nil {
 		defer conn.Close()
+		s.Metrics.HandshakeFailed(err)
 		if s.Logger != nil {
 			s.Logger.Println("unable to negotiate ssh:", err)
 		}
 		return
 	}
 	defer c.Close()
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	slot.authenticate()
+	s.Metrics.HandshakeSucceeded()
+	s.Metrics.ConnectionOpened()
+	defer s.Metrics.ConnectionClosed()
 	c.ProxyDial = s.ProxyDial
 	c.ProxyListen = s.ProxyListen
 	c.Logger = s.Logger
 	c.BytesPool = s.BytesPool
-	c.Environ = s.Environ
+	c.Environ = append(append([]string(nil), s.Environ...), Environment(c.ServerConn.Permissions)...)
 	c.Dir = s.Dir
+	c.Metrics = s.Metrics
+	c.ID = strconv.FormatUint(atomic.AddUint64(&s.lastConnID, 1), 10)
+	c.AuthMethod = auth.method
+	c.AuthMethods = auth.methods
+	c.Motd = s.Motd
+	c.HostKeys = s.HostKeys()
+	c.HostKeyAlgorithm = auth.hostKeyAlgorithm
+	c.PublicKey, _ = PublicKey(c.ServerConn.Permissions)
 	if s.UserPermissions != nil {
 		c.Permissions = s.UserPermissions(c.ServerConn.User())
 	}
+	if s.ConnPermissions != nil {
+		c.Permissions = JoinPermissions(c.Permissions, s.ConnPermissions(c))
+	}
+	c.Permissions = JoinPermissions(c.Permissions, ExtensionsPermissions(c.ServerConn.Permissions))
+	c.Authorizer = s.Authorizer
+	c.Audit = s.Audit
+	s.trackConn(c)
+	defer s.untrackConn(c)
 	c.Handle(s.context())
 }
 
+func (s *Server) trackConn(c *ServerConn) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.conns == nil {
+		s.conns = map[string]*ServerConn{}
+	}
+	s.conns[c.ID] = c
+}
+
+func (s *Server) untrackConn(c *ServerConn) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.conns, c.ID)
+}
+
+// Conns returns the established connections ordered by the time they were established
+func (s *Server) Conns() []*ServerConn {
+	s.mut.Lock()
+	conns := make([]*ServerConn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mut.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Started.Before(conns[j].Started)
+	})
+	return conns
+}
+
+// Conn returns the established connection with the id
+func (s *Server) Conn(id string) (*ServerConn, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	c, ok := s.conns[id]
+	return c, ok
+}
+
+// ConnInfos returns a snapshot of the established connections and their open channels
+func (s *Server) ConnInfos() []ConnInfo {
+	infos := []ConnInfo{}
+	for _, c := range s.Conns() {
+		infos = append(infos, c.Info())
+	}
+	return infos
+}
+
+// Disconnect forcibly closes the connection with the id
+func (s *Server) Disconnect(id string) error {
+	c, ok := s.Conn(id)
+	if !ok {
+		return fmt.Errorf("connection %q not found", id)
+	}
+	return c.Close()
+}
+
+// CloseChannel closes a single channel of the connection with the id
+func (s *Server) CloseChannel(connID, channelID string) error {
+	c, ok := s.Conn(connID)
+	if !ok {
+		return fmt.Errorf("connection %q not found", connID)
+	}
+	return c.CloseChannel(channelID)
+}
+
+// connAuth records the authentication of a single connection
+type connAuth struct {
+	method  string
+	methods []string
+	// hostKeyAlgorithm is set by the first key exchange
+	hostKeyAlgorithm string
+}
+
+// SetHostKeys replaces the host keys of ServerConfig for new connections,
+// existing connections keep the keys they were established with
+func (s *Server) SetHostKeys(keys ...ssh.Signer) {
+	keys = append([]ssh.Signer(nil), keys...)
+	s.hostKeys.Store(&keys)
+}
+
+// HostKeys returns the host keys set by SetHostKeys
+func (s *Server) HostKeys() []ssh.Signer {
+	keys := s.hostKeys.Load()
+	if keys == nil {
+		return nil
+	}
+	return *keys
+}
+
+// serverConfig returns the ssh config for a single connection
+func (s *Server) serverConfig(auth *connAuth) *ssh.ServerConfig {
+	config := s.ServerConfig
+	if keys := s.hostKeys.Load(); keys != nil {
+		// The host keys of a copy are shared with ServerConfig, so a config without them is built
+		config = ssh.ServerConfig{
+			Config:                      s.ServerConfig.Config,
+			PublicKeyAuthAlgorithms:     s.ServerConfig.PublicKeyAuthAlgorithms,
+			NoClientAuth:                s.ServerConfig.NoClientAuth,
+			NoClientAuthCallback:        s.ServerConfig.NoClientAuthCallback,
+			MaxAuthTries:                s.ServerConfig.MaxAuthTries,
+			PasswordCallback:            s.ServerConfig.PasswordCallback,
+			PublicKeyCallback:           s.ServerConfig.PublicKeyCallback,
+			KeyboardInteractiveCallback: s.ServerConfig.KeyboardInteractiveCallback,
+			AuthLogCallback:             s.ServerConfig.AuthLogCallback,
+			PreAuthConnCallback:         s.ServerConfig.PreAuthConnCallback,
+			ServerVersion:               s.ServerConfig.ServerVersion,
+			BannerCallback:              s.ServerConfig.BannerCallback,
+			GSSAPIWithMICConfig:         s.ServerConfig.GSSAPIWithMICConfig,
+		}
+		for _, key := range *keys {
+			config.AddHostKey(recordHostKeyAlgorithm(key, auth))
+		}
+	}
+	authLogCallback := config.AuthLogCallback
+	config.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		var partial *ssh.PartialSuccessError
+		if err == nil {
+			auth.method = method
+			auth.methods = append(auth.methods, method)
+		} else if errors.As(err, &partial) {
+			auth.methods = append(auth.methods, method)
+		}
+		s.Metrics.AuthAttempt(method, err)
+		s.auditAuth(conn, method, err)
+		if s.Guard != nil {
+			if err == nil {
+				s.Guard.AuthSucceeded(conn, method)
+			} else if !errors.As(err, &partial) {
+				s.Guard.AuthFailed(conn, method, err)
+			}
+		}
+		if authLogCallback != nil {
+			authLogCallback(conn, method, err)
+		}
+	}
+	callbacks := recordPublicKey(ssh.ServerAuthCallbacks{
+		PasswordCallback:            config.PasswordCallback,
+		PublicKeyCallback:           config.PublicKeyCallback,
+		KeyboardInteractiveCallback: config.KeyboardInteractiveCallback,
+	}, nil)
+	if s.RevocationList != nil {
+		callbacks = s.checkRevoked(callbacks)
+	}
+	config.PasswordCallback = callbacks.PasswordCallback
+	config.PublicKeyCallback = callbacks.PublicKeyCallback
+	config.KeyboardInteractiveCallback = callbacks.KeyboardInteractiveCallback
+	return &config
+}
+
+// auditAuth records the authentication attempt, except the none method clients start with
+func (s *Server) auditAuth(conn ssh.ConnMetadata, method string, err error) {
+	if s.Audit == nil || (method == "none" && err != nil) {
+		return
+	}
+	event := newAuditEvent(AuditAuth, conn)
+	event.Method = method
+	var partial *ssh.PartialSuccessError
+	switch {
+	case err == nil:
+		event.Allow = true
+	case errors.As(err, &partial):
+		event.Allow = true
+		event.Reason = "partial success"
+	default:
+		event.Reason = err.Error()
+	}
+	err = s.Audit.Audit(event)
+	if err != nil && s.Logger != nil {
+		s.Logger.Println("unable to audit:", err)
+	}
+}
+
+// recordPublicKey wraps the callbacks to record the accepted public key in the permissions,
+// including in those granted by later steps after a partial success
+func recordPublicKey(callbacks ssh.ServerAuthCallbacks, key ssh.PublicKey) ssh.ServerAuthCallbacks {
+	result := func(perms *ssh.Permissions, err error, key ssh.PublicKey) (*ssh.Permissions, error) {
+		var partial *ssh.PartialSuccessError
+		if errors.As(err, &partial) {
+			partial.Next = recordPublicKey(partial.Next, key)
+			return perms, err
+		}
+		if err != nil {
+			return perms, err
+		}
+		return withPublicKey(perms, key), nil
+	}
+	if cb := callbacks.PasswordCallback; cb != nil {
+		callbacks.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perms, err := cb(conn, password)
+			return result(perms, err, key)
+		}
+	}
+	if cb := callbacks.KeyboardInteractiveCallback; cb != nil {
+		callbacks.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			perms, err := cb(conn, client)
+			return result(perms, err, key)
+		}
+	}
+	if cb := callbacks.PublicKeyCallback; cb != nil {
+		callbacks.PublicKeyCallback = func(conn ssh.ConnMetadata, pk ssh.PublicKey) (*ssh.Permissions, error) {
+			perms, err := cb(conn, pk)
+			if key != nil {
+				// The key of the first step is kept
+				return result(perms, err, key)
+			}
+			return result(perms, err, pk)
+		}
+	}
+	return callbacks
+}
+
+// checkRevoked wraps the callbacks to refuse revoked keys,
+// including in the callbacks of later steps after a partial success
+func (s *Server) checkRevoked(callbacks ssh.ServerAuthCallbacks) ssh.ServerAuthCallbacks {
+	next := func(err error) error {
+		var partial *ssh.PartialSuccessError
+		if errors.As(err, &partial) {
+			partial.Next = s.checkRevoked(partial.Next)
+		}
+		return err
+	}
+	if cb := callbacks.PasswordCallback; cb != nil {
+		callbacks.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perms, err := cb(conn, password)
+			return perms, next(err)
+		}
+	}
+	if cb := callbacks.KeyboardInteractiveCallback; cb != nil {
+		callbacks.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			perms, err := cb(conn, client)
+			return perms, next(err)
+		}
+	}
+	if cb := callbacks.PublicKeyCallback; cb != nil {
+		callbacks.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if s.RevocationList.IsRevoked(key) {
+				if s.Logger != nil {
+					s.Logger.Println("refused revoked", describeKey(key), "for", conn.User(), "from", conn.RemoteAddr())
+				}
+				return nil, fmt.Errorf("revoked key %s", ssh.FingerprintSHA256(key))
+			}
+			perms, err := cb(conn, key)
+			return perms, next(err)
+		}
+	}
+	return callbacks
+}
+
+// describeKey returns the fingerprints identifying the key for logs
+func describeKey(key ssh.PublicKey) string {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return fmt.Sprintf("key %s %s", key.Type(), ssh.FingerprintSHA256(key))
+	}
+	return fmt.Sprintf("certificate ID %q serial %d key %s %s signed by CA %s %s",
+		cert.KeyId, cert.Serial,
+		cert.Key.Type(), ssh.FingerprintSHA256(cert.Key),
+		cert.SignatureKey.Type(), ssh.FingerprintSHA256(cert.SignatureKey))
+}
+
 func GetHostkey(key string) (ssh.Signer, error) {
 	f, err := os.ReadFile(key)
 	if err != nil {
@@ -129,6 +494,8 @@ func RandomHostkey() (ssh.Signer, error) {
 
 type Authorized struct {
 	Data map[string]map[string]string
+	// Options of the keys, by FormatPublicKey
+	Options map[string]*KeyOptions
 }
 
 func (a *Authorized) Allow(pk ssh.PublicKey) (bool, string) {
@@ -136,8 +503,63 @@ func (a *Authorized) Allow(pk ssh.PublicKey) (bool, string) {
 	if !ok {
 		return false, ""
 	}
-	comment, ok := pks[FormatPublicKey(pk)]
-	return ok, comment
+	key := FormatPublicKey(pk)
+	comment, ok := pks[key]
+	if !ok {
+		return false, ""
+	}
+	if opts := a.Options[key]; opts != nil && opts.CertAuthority {
+		return false, ""
+	}
+	return true, comment
+}
+
+// PublicKeyCallback authenticates the key and returns the permissions granted by its options,
+// it can be used as ssh.ServerConfig.PublicKeyCallback
+func (a *Authorized) PublicKeyCallback(conn ssh.ConnMetadata, pk ssh.PublicKey) (*ssh.Permissions, error) {
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		return a.authenticateCert(conn, cert)
+	}
+	ok, _ := a.Allow(pk)
+	if !ok {
+		return nil, fmt.Errorf("unauthorized key %s", ssh.FingerprintSHA256(pk))
+	}
+	opts := a.Options[FormatPublicKey(pk)]
+	if opts == nil {
+		return nil, nil
+	}
+	err := opts.Check(conn)
+	if err != nil {
+		return nil, err
+	}
+	return opts.Permissions(), nil
+}
+
+// authenticateCert authenticates a certificate signed by a cert-authority key
+func (a *Authorized) authenticateCert(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	key := FormatPublicKey(cert.SignatureKey)
+	opts := a.Options[key]
+	if _, ok := a.Data[cert.SignatureKey.Type()][key]; !ok || opts == nil || !opts.CertAuthority {
+		return nil, fmt.Errorf("unauthorized certificate authority %s", ssh.FingerprintSHA256(cert.SignatureKey))
+	}
+	err := opts.Check(conn)
+	if err != nil {
+		return nil, err
+	}
+	ca := &CertAuthority{
+		TrustedUserCAKeys: []ssh.PublicKey{cert.SignatureKey},
+	}
+	if opts.Principals != "" {
+		principals := strings.Split(opts.Principals, ",")
+		ca.AuthorizedPrincipals = func(user string) []string {
+			return principals
+		}
+	}
+	perms, err := ca.Authenticate(conn, cert)
+	if err != nil {
+		return nil, err
+	}
+	return mergePermissions(perms, opts)
 }
 
 func GetAuthorizedFile(authorized string) (*Authorized, error) {
@@ -152,6 +574,7 @@ func GetAuthorizedFile(authorized string) (*Authorized, error) {
 
 func ParseAuthorized(r io.Reader) (*Authorized, error) {
 	keys := map[string]map[string]string{}
+	options := map[string]*KeyOptions{}
 	read := bufio.NewReader(r)
 	for {
 		line, _, err := read.ReadLine()
@@ -161,15 +584,26 @@ func ParseAuthorized(r io.Reader) (*Authorized, error) {
 			}
 			return nil, err
 		}
-		if key, cmt, _, _, err := ssh.ParseAuthorizedKey(line); err == nil {
+		if key, cmt, opts, _, err := ssh.ParseAuthorizedKey(line); err == nil {
+			var keyOptions *KeyOptions
+			if len(opts) != 0 {
+				// A line with invalid options is skipped rather than accepted unrestricted
+				keyOptions, err = ParseKeyOptions(opts)
+				if err != nil {
+					continue
+				}
+			}
 			keyType := key.Type()
 			if keys[keyType] == nil {
 				keys[keyType] = map[string]string{}
 			}
 			keys[keyType][FormatPublicKey(key)] = cmt
+			if keyOptions != nil {
+				options[FormatPublicKey(key)] = keyOptions
+			}
 		}
 	}
-	return &Authorized{keys}, nil
+	return &Authorized{keys, options}, nil
 }
 
 func FormatPublicKey(pk ssh.PublicKey) string {
@@ -2,7 +2,12 @@ package sshd
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -23,6 +28,15 @@ func RegistryHandleRequest(name string, fun HandleRequestFunc) {
 	registryRequest[name] = fun
 }
 
+type HandleConnFunc func(ctx context.Context, serverConn *ServerConn)
+
+var registryConn = map[string]HandleConnFunc{}
+
+// RegistryHandleConn registers a function run when a connection is established
+func RegistryHandleConn(name string, fun HandleConnFunc) {
+	registryConn[name] = fun
+}
+
 // ServerConn Handling for a single incoming connection
 type ServerConn struct {
 	*ssh.ServerConn
@@ -47,6 +61,43 @@ type ServerConn struct {
 	// Permissions specify the permissions that the user has
 	// If nil, then allow all
 	Permissions Permissions
+	// Authorizer decides the channels and requests the permissions allow
+	// If nil, then the permissions decide alone
+	Authorizer Authorizer
+	// Audit records the authorization decisions
+	// If nil, then nothing is recorded
+	Audit AuditSink
+	// Metrics records statistics of the connection
+	// If nil, then nothing is recorded
+	Metrics *Metrics
+	// ID is unique within the server
+	ID string
+	// Started is the time the connection was established
+	Started time.Time
+	// AuthMethod is the authentication method that succeeded
+	AuthMethod string
+	// AuthMethods are the authentication methods completed, in order
+	AuthMethods []string
+	// Motd returns the message shown to interactive sessions
+	// If nil, then nothing is shown
+	Motd func(conn *ServerConn) string
+	// HostKeys are the host keys the connection may use
+	// If nil, then they are not known
+	HostKeys []ssh.Signer
+	// HostKeyAlgorithm is the signature algorithm of the host key negotiated by the first key exchange
+	// If empty, then it is not known
+	HostKeyAlgorithm string
+	// PublicKey is the public key or certificate the connection authenticated with
+	// If nil, then no public key was used
+	PublicKey ssh.PublicKey
+
+	mut           sync.Mutex
+	channels      map[string]*Channel
+	lastChannelID uint64
+	forwards      map[string]*Forward
+	lastForwardID uint64
+	// forwardsClosed is set once the connection closes its forwards
+	forwardsClosed bool
 }
 
 func NewServerConn(conn net.Conn, config *ssh.ServerConfig) (*ServerConn, error) {
@@ -58,13 +109,96 @@ func NewServerConn(conn net.Conn, config *ssh.ServerConfig) (*ServerConn, error)
 		ServerConn: serverConn,
 		Requests:   requests,
 		Channels:   channels,
+		Started:    time.Now(),
 	}, nil
 }
 
-// Handle a single established connection
+// ConnInfo describes an established connection
+type ConnInfo struct {
+	ID            string        `json:"id"`
+	User          string        `json:"user"`
+	RemoteAddr    string        `json:"remote_addr"`
+	ClientVersion string        `json:"client_version"`
+	AuthMethod    string        `json:"auth_method,omitempty"`
+	AuthMethods   []string      `json:"auth_methods,omitempty"`
+	Started       time.Time     `json:"started"`
+	Channels      []ChannelInfo `json:"channels"`
+	Forwards      []ForwardInfo `json:"forwards"`
+}
+
+// Info returns a snapshot of the connection and its open channels
+func (s *ServerConn) Info() ConnInfo {
+	channels := []ChannelInfo{}
+	for _, ch := range s.OpenChannels() {
+		channels = append(channels, ch.Info())
+	}
+	forwards := []ForwardInfo{}
+	for _, f := range s.Forwards() {
+		forwards = append(forwards, f.Info())
+	}
+	return ConnInfo{
+		ID:            s.ID,
+		User:          s.User(),
+		RemoteAddr:    s.RemoteAddr().String(),
+		ClientVersion: string(s.ClientVersion()),
+		AuthMethod:    s.AuthMethod,
+		AuthMethods:   s.AuthMethods,
+		Started:       s.Started,
+		Channels:      channels,
+		Forwards:      forwards,
+	}
+}
+
+// OpenChannels returns the open channels ordered by the time they were opened
+func (s *ServerConn) OpenChannels() []*Channel {
+	s.mut.Lock()
+	channels := make([]*Channel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	s.mut.Unlock()
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Started.Before(channels[j].Started)
+	})
+	return channels
+}
+
+// CloseChannel closes the open channel with the id
+func (s *ServerConn) CloseChannel(id string) error {
+	s.mut.Lock()
+	ch, ok := s.channels[id]
+	s.mut.Unlock()
+	if !ok {
+		return fmt.Errorf("channel %q not found", id)
+	}
+	return ch.Close()
+}
+
+// OpenChannel tries to open a channel to the client, the channel is tracked until it is closed
+func (s *ServerConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := s.ServerConn.OpenChannel(name, data)
+	if err != nil {
+		s.Metrics.ChannelRejected(name)
+		return nil, nil, err
+	}
+	s.Metrics.ChannelOpened(name)
+	return s.trackChannel(name, data, ch), reqs, nil
+}
+
+// Handle a single established connection,
+// the context of the handlers is cancelled and the forwards are closed when it ends
 func (s *ServerConn) Handle(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, handle := range registryConn {
+		if handle != nil {
+			go handle(ctx, s)
+		}
+	}
 	go s.handleRequests(ctx)
 	s.handleChannels(ctx)
+	// The forwards are owned by the connection and do not outlive it
+	s.closeForwards()
 }
 
 func (s *ServerConn) handleRequests(ctx context.Context) {
@@ -95,6 +229,10 @@ func (s *ServerConn) handleChannels(ctx context.Context) {
 			if !ok {
 				return
 			}
+			newChan = &trackNewChannel{NewChannel: newChan, serverConn: s}
+			if s.Metrics != nil {
+				newChan = &metricsNewChannel{NewChannel: newChan, metrics: s.Metrics}
+			}
 			chType := newChan.ChannelType()
 			channel, ok := registryChannel[chType]
 			if ok && channel != nil {
@@ -121,3 +259,39 @@ func DiscardRequests(logger Logger, in <-chan *ssh.Request) {
 		}
 	}
 }
+
+// Tunnel create tunnels between the channel and conn,
+// the bytes transferred are recorded under the channel type
+func (s *ServerConn) Tunnel(ctx context.Context, chType string, ch ssh.Channel, conn io.ReadWriteCloser) error {
+	var buf1, buf2 []byte
+	if s.BytesPool != nil {
+		buf1 = s.BytesPool.Get()
+		buf2 = s.BytesPool.Get()
+		defer func() {
+			s.BytesPool.Put(buf1)
+			s.BytesPool.Put(buf2)
+		}()
+	} else {
+		buf1 = make([]byte, 32*1024)
+		buf2 = make([]byte, 32*1024)
+	}
+
+	in := &countReadWriteCloser{ReadWriteCloser: ch, metrics: s.Metrics, chType: chType, direction: "in"}
+	out := &countReadWriteCloser{ReadWriteCloser: conn, metrics: s.Metrics, chType: chType, direction: "out"}
+	return Tunnel(ctx, in, out, buf1, buf2)
+}
+
+// countReadWriteCloser records the bytes read as they are read,
+// so long-lived tunnels are seen while they are open
+type countReadWriteCloser struct {
+	io.ReadWriteCloser
+	metrics   *Metrics
+	chType    string
+	direction string
+}
+
+func (c *countReadWriteCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.metrics.TunnelBytes(c.chType, c.direction, int64(n))
+	return n, err
+}
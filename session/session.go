@@ -3,8 +3,10 @@ package session
 import (
 	"context"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/google/shlex"
 	"github.com/wzshiming/sshd"
@@ -15,6 +17,11 @@ import (
 type Session struct{}
 
 func (s *Session) Handle(ctx context.Context, newChan ssh.NewChannel, serverConn *sshd.ServerConn) {
+	if decision := serverConn.Authorize(ctx, &sshd.AuthorizeRequest{Type: name}); !decision.Allow {
+		newChan.Reject(ssh.Prohibited, decision.Reason)
+		return
+	}
+
 	ch, reqs, err := newChan.Accept()
 	if err != nil {
 		if serverConn.Logger != nil {
@@ -28,19 +35,12 @@ func (s *Session) Handle(ctx context.Context, newChan ssh.NewChannel, serverConn
 		ch.Close()
 	}()
 
-	if serverConn.Permissions != nil && !serverConn.Permissions.Allow(name, "") {
-		if serverConn.Logger != nil {
-			serverConn.Logger.Println("prohibited:", name)
-		}
-		newChan.Reject(ssh.Prohibited, "Error administratively prohibited")
-		return
-	}
-
 	var (
 		ptyReq        *sshd.PtyRequestMsg
 		winChangeChan chan *sshd.PtyWindowChangeMsg
 	)
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for {
 		select {
 		case <-ctx.Done():
@@ -51,9 +51,9 @@ func (s *Session) Handle(ctx context.Context, newChan ssh.NewChannel, serverConn
 			}
 			sess := true
 
-			if serverConn.Permissions != nil && !serverConn.Permissions.Allow(name, req.Type) {
-				if serverConn.Logger != nil {
-					serverConn.Logger.Println("error administratively req:", req.Type)
+			if decision := serverConn.Authorize(ctx, &sshd.AuthorizeRequest{Type: name, Args: req.Type, Msg: req}); !decision.Allow {
+				if req.WantReply {
+					req.Reply(false, nil)
 				}
 				continue
 			}
@@ -89,7 +89,13 @@ func (s *Session) Handle(ctx context.Context, newChan ssh.NewChannel, serverConn
 				}
 				s.Setenv(serverConn, envreq.Name, envreq.Value)
 			case "shell":
-				err := s.Shell(ctx, serverConn, ch, cancel, ptyReq, winChangeChan)
+				s.motd(serverConn, ch, ptyReq)
+				var err error
+				if command, ok := sshd.ForceCommand(serverConn.ServerConn.Permissions); ok {
+					err = s.Execute(ctx, serverConn, ch, cancel, command)
+				} else {
+					err = s.Shell(ctx, serverConn, ch, cancel, ptyReq, winChangeChan)
+				}
 				if err != nil {
 					if serverConn.Logger != nil {
 						serverConn.Logger.Println("error execute:", err)
@@ -104,7 +110,12 @@ func (s *Session) Handle(ctx context.Context, newChan ssh.NewChannel, serverConn
 					}
 					return
 				}
-				err := s.Execute(ctx, serverConn, ch, cancel, execReq.Command)
+				command := execReq.Command
+				if forceCommand, ok := sshd.ForceCommand(serverConn.ServerConn.Permissions); ok {
+					s.Setenv(serverConn, "SSH_ORIGINAL_COMMAND", command)
+					command = forceCommand
+				}
+				err := s.Execute(ctx, serverConn, ch, cancel, command)
 				if err != nil {
 					if serverConn.Logger != nil {
 						serverConn.Logger.Println("error execute:", err)
@@ -150,6 +161,20 @@ func (s *Session) Setenv(serverConn *sshd.ServerConn, key, val string) {
 	serverConn.Environ = append(serverConn.Environ, fmt.Sprintf("%s=%s", key, val))
 }
 
+// motd writes the message of the day to interactive shells, those that requested a pty
+func (s *Session) motd(serverConn *sshd.ServerConn, ch ssh.Channel, ptyReq *sshd.PtyRequestMsg) {
+	if ptyReq == nil || serverConn.Motd == nil {
+		return
+	}
+	msg := serverConn.Motd(serverConn)
+	if msg == "" {
+		return
+	}
+	// The terminal of the client is raw, so the newlines are translated as a pty would
+	msg = strings.ReplaceAll(strings.ReplaceAll(msg, "\r\n", "\n"), "\n", "\r\n")
+	io.WriteString(ch, msg)
+}
+
 // Shell a process for the channel.
 func (s *Session) Shell(ctx context.Context, serverConn *sshd.ServerConn, ch ssh.Channel, cancel func(), ptyReq *sshd.PtyRequestMsg, winChangeChan chan *sshd.PtyWindowChangeMsg) error {
 	return fmt.Errorf("not support shell")
@@ -168,12 +193,14 @@ func (s *Session) Execute(ctx context.Context, serverConn *sshd.ServerConn, ch s
 	command.Stdin = ch
 	command.Stderr = ch.Stderr()
 
+	start := time.Now()
 	err = command.Start()
 	if err != nil {
 		return err
 	}
 	go func() {
-		command.Wait()
+		err := command.Wait()
+		serverConn.Metrics.ExecDuration(time.Since(start), err)
 		cancel()
 	}()
 	return nil
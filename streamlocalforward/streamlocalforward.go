@@ -2,22 +2,22 @@ package streamlocalforward
 
 import (
 	"context"
-	"io"
+	"errors"
 	"net"
-	"sync"
 
 	"github.com/wzshiming/sshd"
 	"golang.org/x/crypto/ssh"
 )
 
-// StreamLocalForward Handling for a single incoming connection
-type StreamLocalForward struct {
-	mut     sync.Mutex
-	cancels map[string]io.Closer
-}
+// StreamLocalForward Handling for a single incoming connection,
+// the forwards are owned by the connection that requested them
+type StreamLocalForward struct{}
 
-func (s *StreamLocalForward) forwardListener(ctx context.Context, serverConn *sshd.ServerConn, listener net.Listener) {
+func (s *StreamLocalForward) forwardListener(ctx context.Context, serverConn *sshd.ServerConn, listener net.Listener, forward *sshd.Forward) {
 	defer listener.Close()
+	serverConn.Metrics.ForwardListenerOpened(name)
+	defer serverConn.Metrics.ForwardListenerClosed(name)
+	defer serverConn.UntrackForward(forward)
 
 	for {
 		conn, err := listener.Accept()
@@ -38,9 +38,15 @@ func (s *StreamLocalForward) forwardListener(ctx context.Context, serverConn *ss
 		data := ssh.Marshal(resp)
 		chans, reqs, err := serverConn.OpenChannel("forwarded-streamlocal@openssh.com", data)
 		if err != nil {
+			conn.Close()
 			if serverConn.Logger != nil {
 				serverConn.Logger.Println("OpenChannel:", err)
 			}
+			// Only a rejection of the channel leaves the connection usable
+			var rejected *ssh.OpenChannelError
+			if errors.As(err, &rejected) {
+				continue
+			}
 			return
 		}
 
@@ -51,19 +57,7 @@ func (s *StreamLocalForward) forwardListener(ctx context.Context, serverConn *ss
 }
 
 func (s *StreamLocalForward) tunnel(ctx context.Context, serverConn *sshd.ServerConn, conn net.Conn, chans ssh.Channel) {
-	var buf1, buf2 []byte
-	if serverConn.BytesPool != nil {
-		buf1 = serverConn.BytesPool.Get()
-		buf2 = serverConn.BytesPool.Get()
-		defer func() {
-			serverConn.BytesPool.Put(buf1)
-			serverConn.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
-	}
-	err := sshd.Tunnel(ctx, conn, chans, buf1, buf2)
+	err := serverConn.Tunnel(ctx, "forwarded-streamlocal@openssh.com", chans, conn)
 	if err != nil && !sshd.IsClosedConnError(err) {
 		if serverConn.Logger != nil {
 			serverConn.Logger.Println("Tunnel:", err)
@@ -72,8 +66,6 @@ func (s *StreamLocalForward) tunnel(ctx context.Context, serverConn *sshd.Server
 }
 
 func (s *StreamLocalForward) Forward(ctx context.Context, req *ssh.Request, serverConn *sshd.ServerConn) {
-	s.mut.Lock()
-	defer s.mut.Unlock()
 	m := sshd.StreamLocalChannelForwardMsg{}
 	err := ssh.Unmarshal(req.Payload, &m)
 	if err != nil {
@@ -84,12 +76,19 @@ func (s *StreamLocalForward) Forward(ctx context.Context, req *ssh.Request, serv
 		return
 	}
 
-	if serverConn.Permissions != nil && !serverConn.Permissions.Allow(name, m.SocketPath) {
+	if decision := serverConn.Authorize(ctx, &sshd.AuthorizeRequest{Type: name, Args: m.SocketPath, Msg: &m}); !decision.Allow {
 		req.Reply(false, nil)
 		return
 	}
 
-	s.cancelPath(m.SocketPath)
+	// A bind of the connection is refused rather than replaced, those of others fail to listen
+	if _, ok := serverConn.LookupForward(name, m.SocketPath); ok {
+		if serverConn.Logger != nil {
+			serverConn.Logger.Println("already forwarded:", m.SocketPath)
+		}
+		req.Reply(false, nil)
+		return
+	}
 
 	listener, err := s.proxyListen(ctx, serverConn, "unix", m.SocketPath)
 	if err != nil {
@@ -100,8 +99,15 @@ func (s *StreamLocalForward) Forward(ctx context.Context, req *ssh.Request, serv
 		return
 	}
 
-	s.setCancelPath(m.SocketPath, listener)
-	go s.forwardListener(ctx, serverConn, listener)
+	forward, err := serverConn.TrackForward(name, m.SocketPath, listener)
+	if err != nil {
+		if serverConn.Logger != nil {
+			serverConn.Logger.Println("TrackForward:", err)
+		}
+		req.Reply(false, nil)
+		return
+	}
+	go s.forwardListener(ctx, serverConn, listener, forward)
 
 	req.Reply(true, nil)
 }
@@ -115,9 +121,8 @@ func (s *StreamLocalForward) proxyListen(ctx context.Context, serverConn *sshd.S
 	return proxyListen(ctx, network, address)
 }
 
+// Cancel closes a forward of the connection
 func (s *StreamLocalForward) Cancel(ctx context.Context, req *ssh.Request, serverConn *sshd.ServerConn) {
-	s.mut.Lock()
-	defer s.mut.Unlock()
 	m := sshd.StreamLocalChannelForwardMsg{}
 	err := ssh.Unmarshal(req.Payload, &m)
 	if err != nil {
@@ -128,31 +133,20 @@ func (s *StreamLocalForward) Cancel(ctx context.Context, req *ssh.Request, serve
 		return
 	}
 
-	if serverConn.Permissions != nil && !serverConn.Permissions.Allow(name, m.SocketPath) {
+	if decision := serverConn.Authorize(ctx, &sshd.AuthorizeRequest{Type: name, Args: m.SocketPath, Msg: &m}); !decision.Allow {
 		req.Reply(false, nil)
 		return
 	}
 
-	s.cancelPath(m.SocketPath)
-	req.Reply(true, nil)
-}
-
-func (s *StreamLocalForward) cancelPath(path string) {
-	if s.cancels == nil {
+	forward, ok := serverConn.LookupForward(name, m.SocketPath)
+	if !ok {
+		if serverConn.Logger != nil {
+			serverConn.Logger.Println("not forwarded:", m.SocketPath)
+		}
+		req.Reply(false, nil)
 		return
 	}
-	if cancel, ok := s.cancels[path]; ok {
-		cancel.Close()
-		delete(s.cancels, path)
-	}
-}
-
-func (s *StreamLocalForward) setCancelPath(path string, cf io.Closer) {
-	if s.cancels == nil {
-		s.cancels = map[string]io.Closer{}
-	}
-	if cancel, ok := s.cancels[path]; ok {
-		cancel.Close()
-	}
-	s.cancels[path] = cf
+	serverConn.UntrackForward(forward)
+	forward.Close()
+	req.Reply(true, nil)
 }
@@ -2,31 +2,23 @@ package tcpforward
 
 import (
 	"context"
-	"fmt"
-	"io"
+	"errors"
 	"net"
 	"strconv"
-	"sync"
 
 	"github.com/wzshiming/sshd"
 	"golang.org/x/crypto/ssh"
 )
 
-// TCPForward Handling for a single incoming connection
-type TCPForward struct {
-	mut     sync.Mutex
-	cancels map[uint32]io.Closer
-}
+// TCPForward Handling for a single incoming connection,
+// the forwards are owned by the connection that requested them
+type TCPForward struct{}
 
-func (s *TCPForward) forwardListener(ctx context.Context, serverConn *sshd.ServerConn, listener net.Listener) {
+func (s *TCPForward) forwardListener(ctx context.Context, serverConn *sshd.ServerConn, listener net.Listener, forward *sshd.Forward, addr string, port uint32) {
 	defer listener.Close()
-	_, port, err := ParseAddr(listener.Addr().String())
-	if err != nil {
-		if serverConn.Logger != nil {
-			serverConn.Logger.Println("ParseAddr:", err)
-		}
-		return
-	}
+	serverConn.Metrics.ForwardListenerOpened(name)
+	defer serverConn.Metrics.ForwardListenerClosed(name)
+	defer serverConn.UntrackForward(forward)
 
 	for {
 		conn, err := listener.Accept()
@@ -45,10 +37,11 @@ func (s *TCPForward) forwardListener(ctx context.Context, serverConn *sshd.Serve
 			if serverConn.Logger != nil {
 				serverConn.Logger.Println("ParseAddr:", err)
 			}
-			return
+			conn.Close()
+			continue
 		}
 		resp := sshd.ForwardedTCPPayload{
-			Addr:       "0.0.0.0",
+			Addr:       addr,
 			Port:       port,
 			OriginAddr: ohost,
 			OriginPort: oport,
@@ -57,9 +50,15 @@ func (s *TCPForward) forwardListener(ctx context.Context, serverConn *sshd.Serve
 		data := ssh.Marshal(resp)
 		chans, reqs, err := serverConn.OpenChannel("forwarded-tcpip", data)
 		if err != nil {
+			conn.Close()
 			if serverConn.Logger != nil {
 				serverConn.Logger.Println("OpenChannel:", err)
 			}
+			// Only a rejection of the channel leaves the connection usable
+			var rejected *ssh.OpenChannelError
+			if errors.As(err, &rejected) {
+				continue
+			}
 			return
 		}
 
@@ -70,19 +69,7 @@ func (s *TCPForward) forwardListener(ctx context.Context, serverConn *sshd.Serve
 }
 
 func (s *TCPForward) tunnel(ctx context.Context, serverConn *sshd.ServerConn, conn net.Conn, chans ssh.Channel) {
-	var buf1, buf2 []byte
-	if serverConn.BytesPool != nil {
-		buf1 = serverConn.BytesPool.Get()
-		buf2 = serverConn.BytesPool.Get()
-		defer func() {
-			serverConn.BytesPool.Put(buf1)
-			serverConn.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
-	}
-	err := sshd.Tunnel(ctx, conn, chans, buf1, buf2)
+	err := serverConn.Tunnel(ctx, "forwarded-tcpip", chans, conn)
 	if err != nil && !sshd.IsClosedConnError(err) {
 		if serverConn.Logger != nil {
 			serverConn.Logger.Println("Tunnel:", err)
@@ -91,8 +78,6 @@ func (s *TCPForward) tunnel(ctx context.Context, serverConn *sshd.ServerConn, co
 }
 
 func (s *TCPForward) Forward(ctx context.Context, req *ssh.Request, serverConn *sshd.ServerConn) {
-	s.mut.Lock()
-	defer s.mut.Unlock()
 	m := sshd.ForwardMsg{}
 	err := ssh.Unmarshal(req.Payload, &m)
 	if err != nil {
@@ -103,13 +88,22 @@ func (s *TCPForward) Forward(ctx context.Context, req *ssh.Request, serverConn *
 		return
 	}
 
-	local := fmt.Sprintf("%s:%d", formatLocalAddr(m.LAddr), m.LPort)
-	if serverConn.Permissions != nil && !serverConn.Permissions.Allow(name, local) {
+	local := localAddr(m.LAddr, m.LPort)
+	if decision := serverConn.Authorize(ctx, &sshd.AuthorizeRequest{Type: name, Args: local, Msg: &m}); !decision.Allow {
 		req.Reply(false, nil)
 		return
 	}
 
-	s.cancelPort(m.LPort)
+	// A bind of the connection is refused rather than replaced, those of others fail to listen
+	if m.LPort != 0 {
+		if _, ok := serverConn.LookupForward(name, local); ok {
+			if serverConn.Logger != nil {
+				serverConn.Logger.Println("already forwarded:", local)
+			}
+			req.Reply(false, nil)
+			return
+		}
+	}
 
 	listener, err := s.proxyListen(ctx, serverConn, "tcp", local)
 	if err != nil {
@@ -125,12 +119,20 @@ func (s *TCPForward) Forward(ctx context.Context, req *ssh.Request, serverConn *
 		if serverConn.Logger != nil {
 			serverConn.Logger.Println("ParseAddr:", err)
 		}
+		listener.Close()
 		req.Reply(false, nil)
 		return
 	}
 
-	s.setCancelPort(port, listener)
-	go s.forwardListener(ctx, serverConn, listener)
+	forward, err := serverConn.TrackForward(name, localAddr(m.LAddr, port), listener)
+	if err != nil {
+		if serverConn.Logger != nil {
+			serverConn.Logger.Println("TrackForward:", err)
+		}
+		req.Reply(false, nil)
+		return
+	}
+	go s.forwardListener(ctx, serverConn, listener, forward, m.LAddr, port)
 
 	resp := ssh.Marshal(sshd.ForwardResponseMsg{
 		Port: port,
@@ -147,9 +149,8 @@ func (s *TCPForward) proxyListen(ctx context.Context, serverConn *sshd.ServerCon
 	return proxyListen(ctx, network, address)
 }
 
+// Cancel closes a forward of the connection
 func (s *TCPForward) Cancel(ctx context.Context, req *ssh.Request, serverConn *sshd.ServerConn) {
-	s.mut.Lock()
-	defer s.mut.Unlock()
 	m := sshd.ForwardMsg{}
 	err := ssh.Unmarshal(req.Payload, &m)
 	if err != nil {
@@ -160,34 +161,23 @@ func (s *TCPForward) Cancel(ctx context.Context, req *ssh.Request, serverConn *s
 		return
 	}
 
-	local := fmt.Sprintf("%s:%d", formatLocalAddr(m.LAddr), m.LPort)
-	if serverConn.Permissions != nil && !serverConn.Permissions.Allow(name, local) {
+	local := localAddr(m.LAddr, m.LPort)
+	if decision := serverConn.Authorize(ctx, &sshd.AuthorizeRequest{Type: name, Args: local, Msg: &m}); !decision.Allow {
 		req.Reply(false, nil)
 		return
 	}
 
-	s.cancelPort(m.LPort)
-	req.Reply(true, nil)
-}
-
-func (s *TCPForward) cancelPort(port uint32) {
-	if s.cancels == nil {
+	forward, ok := serverConn.LookupForward(name, local)
+	if !ok {
+		if serverConn.Logger != nil {
+			serverConn.Logger.Println("not forwarded:", local)
+		}
+		req.Reply(false, nil)
 		return
 	}
-	if cancel, ok := s.cancels[port]; ok {
-		cancel.Close()
-		delete(s.cancels, port)
-	}
-}
-
-func (s *TCPForward) setCancelPort(port uint32, cf io.Closer) {
-	if s.cancels == nil {
-		s.cancels = map[uint32]io.Closer{}
-	}
-	if cancel, ok := s.cancels[port]; ok {
-		cancel.Close()
-	}
-	s.cancels[port] = cf
+	serverConn.UntrackForward(forward)
+	forward.Close()
+	req.Reply(true, nil)
 }
 
 func ParseAddr(addr string) (string, uint32, error) {
@@ -202,6 +192,11 @@ func ParseAddr(addr string) (string, uint32, error) {
 	return host, uint32(port), nil
 }
 
+// localAddr is the address to listen on for the bind address and port of a request
+func localAddr(addr string, port uint32) string {
+	return net.JoinHostPort(formatLocalAddr(addr), strconv.FormatUint(uint64(port), 10))
+}
+
 func formatLocalAddr(addr string) string {
 	if addr == "" {
 		return ""
@@ -0,0 +1,238 @@
+package totp
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrInvalidCode is returned when the code does not match
+	ErrInvalidCode = errors.New("invalid verification code")
+	// ErrReplayed is returned when the code was already used
+	ErrReplayed = errors.New("verification code already used")
+	// ErrNoSecret is returned when the user has no secret
+	ErrNoSecret = errors.New("no verification secret")
+)
+
+// Authenticator verifies RFC 6238 time-based one-time passwords over keyboard-interactive authentication
+type Authenticator struct {
+	// Secrets is the shared secret by username
+	Secrets map[string][]byte
+	// Period is the time step of the codes, a whole number of seconds
+	// If zero, then 30 seconds
+	Period time.Duration
+	// Digits is the number of digits of the codes
+	// If zero, then 6
+	Digits int
+	// Skew is the number of time steps accepted before and after the current one
+	Skew int
+	// Optional lets users without a secret authenticate by their key alone with PublicKeyCallback,
+	// KeyboardInteractiveCallback always refuses them
+	Optional bool
+	// Prompt is shown to the user
+	// If empty, then "Verification code: "
+	Prompt string
+	// Logger error log
+	Logger sshd.Logger
+
+	mut  sync.Mutex
+	used map[string]uint64
+}
+
+func (a *Authenticator) period() time.Duration {
+	if a.Period <= 0 {
+		return 30 * time.Second
+	}
+	return a.Period
+}
+
+func (a *Authenticator) digits() int {
+	if a.Digits <= 0 {
+		return 6
+	}
+	return a.Digits
+}
+
+func (a *Authenticator) prompt() string {
+	if a.Prompt == "" {
+		return "Verification code: "
+	}
+	return a.Prompt
+}
+
+// Verify checks the code of the user at the time, each time step is accepted at most once
+func (a *Authenticator) Verify(user, code string, t time.Time) error {
+	secret, ok := a.Secrets[user]
+	if !ok {
+		return ErrNoSecret
+	}
+	period := a.period()
+	if period < time.Second || period%time.Second != 0 {
+		return fmt.Errorf("period %s is not a whole number of seconds", period)
+	}
+	code = strings.TrimSpace(code)
+	step := uint64(t.Unix()) / uint64(period/time.Second)
+
+	// Every step in the window is compared to not leak which one matched
+	var matched uint64
+	found := 0
+	for i := -a.Skew; i <= a.Skew; i++ {
+		counter := step + uint64(i)
+		want := HOTP(secret, counter, a.digits())
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			matched = counter
+			found = 1
+		}
+	}
+	if found == 0 {
+		return ErrInvalidCode
+	}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if last, ok := a.used[user]; ok && matched <= last {
+		return ErrReplayed
+	}
+	if a.used == nil {
+		a.used = map[string]uint64{}
+	}
+	a.used[user] = matched
+	return nil
+}
+
+// KeyboardInteractiveCallback asks for the code of the user,
+// it can be used as ssh.ServerConfig.KeyboardInteractiveCallback
+func (a *Authenticator) KeyboardInteractiveCallback(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	user := conn.User()
+	if _, ok := a.Secrets[user]; !ok {
+		return nil, fmt.Errorf("%w for %q", ErrNoSecret, user)
+	}
+	answers, err := client(user, "", []string{a.prompt()}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, fmt.Errorf("expected 1 answer, got %d", len(answers))
+	}
+	err = a.Verify(user, answers[0], time.Now())
+	if err != nil {
+		if a.Logger != nil {
+			a.Logger.Println("verification failed for", user, "from", conn.RemoteAddr(), err)
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// PublicKeyCallback returns a ssh.ServerConfig.PublicKeyCallback that requires the code
+// through keyboard-interactive after the key is accepted by next,
+// the permissions of the key are granted once the code is verified
+func (a *Authenticator) PublicKeyCallback(next func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		perms, err := next(conn, key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := a.Secrets[conn.User()]; !ok && a.Optional {
+			return perms, nil
+		}
+		return nil, &ssh.PartialSuccessError{
+			Next: ssh.ServerAuthCallbacks{
+				KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					_, err := a.KeyboardInteractiveCallback(conn, client)
+					if err != nil {
+						return nil, err
+					}
+					return perms, nil
+				},
+			},
+		}
+	}
+}
+
+// HOTP returns the RFC 4226 HMAC-SHA1 one-time password of the counter
+func HOTP(secret []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// NewSecret returns a random 160-bit secret encoded in base32 without padding
+func NewSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// DecodeSecret decodes a base32 secret, ignoring case, spaces and padding
+func DecodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	secret = strings.TrimRight(secret, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// GetSecretsFile reads the secrets of a file of user:base32-secret lines
+func GetSecretsFile(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseSecrets(f)
+}
+
+// ParseSecrets parses user:base32-secret lines, ignoring empty lines and lines starting with '#'
+func ParseSecrets(r io.Reader) (map[string][]byte, error) {
+	secrets := map[string][]byte{}
+	read := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := read.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if text := strings.TrimSpace(line); text != "" && !strings.HasPrefix(text, "#") {
+			user, secret, ok := strings.Cut(text, ":")
+			if !ok || user == "" {
+				return nil, fmt.Errorf("line %d: expected user:secret", n)
+			}
+			key, err := DecodeSecret(secret)
+			if err != nil || len(key) == 0 {
+				return nil, fmt.Errorf("line %d: invalid secret for %q", n, user)
+			}
+			secrets[user] = key
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return secrets, nil
+}
@@ -0,0 +1,125 @@
+package totp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Test vectors of RFC 6238 Appendix B for HMAC-SHA1
+func TestVerifyRFC6238(t *testing.T) {
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		a := &Authenticator{
+			Secrets: map[string][]byte{"alice": []byte("12345678901234567890")},
+			Digits:  8,
+		}
+		if err := a.Verify("alice", tt.code, time.Unix(tt.time, 0)); err != nil {
+			t.Errorf("Verify(%s) at %d = %v", tt.code, tt.time, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := uint64(now.Unix() / 30)
+	a := &Authenticator{
+		Secrets: map[string][]byte{"alice": secret, "bob": secret},
+		Skew:    1,
+	}
+
+	if err := a.Verify("carol", HOTP(secret, step, 6), now); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("Verify() of a user without secret = %v, want ErrNoSecret", err)
+	}
+	if err := a.Verify("alice", HOTP(secret, step+2, 6), now); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Verify() outside the skew = %v, want ErrInvalidCode", err)
+	}
+	if err := a.Verify("alice", HOTP(secret, step-1, 6), now); err != nil {
+		t.Errorf("Verify() of the previous step = %v", err)
+	}
+	if err := a.Verify("alice", HOTP(secret, step, 6), now); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+	// The same code, or an earlier one still within the skew, is refused once used
+	if err := a.Verify("alice", HOTP(secret, step, 6), now); !errors.Is(err, ErrReplayed) {
+		t.Errorf("Verify() replayed = %v, want ErrReplayed", err)
+	}
+	if err := a.Verify("alice", HOTP(secret, step-1, 6), now); !errors.Is(err, ErrReplayed) {
+		t.Errorf("Verify() of an earlier step = %v, want ErrReplayed", err)
+	}
+	// Codes are used up per user
+	if err := a.Verify("bob", HOTP(secret, step, 6), now); err != nil {
+		t.Errorf("Verify() of another user = %v", err)
+	}
+	if err := a.Verify("alice", HOTP(secret, step+1, 6), now); err != nil {
+		t.Errorf("Verify() of the next step = %v", err)
+	}
+}
+
+func TestVerifyPeriod(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, period := range []time.Duration{time.Millisecond, 1500 * time.Millisecond} {
+		a := &Authenticator{
+			Secrets: map[string][]byte{"alice": secret},
+			Period:  period,
+		}
+		if err := a.Verify("alice", "000000", time.Unix(59, 0)); err == nil || errors.Is(err, ErrInvalidCode) {
+			t.Errorf("Verify() with period %s = %v, want a period error", period, err)
+		}
+	}
+	a := &Authenticator{
+		Secrets: map[string][]byte{"alice": secret},
+		Period:  time.Minute,
+	}
+	if err := a.Verify("alice", HOTP(secret, 2, 6), time.Unix(150, 0)); err != nil {
+		t.Errorf("Verify() with period 1m = %v", err)
+	}
+}
+
+type testConn struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c *testConn) User() string { return c.user }
+
+func TestOptional(t *testing.T) {
+	a := &Authenticator{
+		Secrets:  map[string][]byte{"alice": []byte("12345678901234567890")},
+		Optional: true,
+	}
+	challenge := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{"000000"}, nil
+	}
+	_, err := a.KeyboardInteractiveCallback(&testConn{user: "bob"}, challenge)
+	if !errors.Is(err, ErrNoSecret) {
+		t.Errorf("KeyboardInteractiveCallback() of a user without secret = %v, want ErrNoSecret", err)
+	}
+
+	granted := &ssh.Permissions{}
+	callback := a.PublicKeyCallback(func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return granted, nil
+	})
+	perms, err := callback(&testConn{user: "bob"}, nil)
+	if err != nil || perms != granted {
+		t.Errorf("PublicKeyCallback() of a user without secret = %v, %v", perms, err)
+	}
+	var partial *ssh.PartialSuccessError
+	_, err = callback(&testConn{user: "alice"}, nil)
+	if !errors.As(err, &partial) {
+		t.Errorf("PublicKeyCallback() of a user with secret = %v, want a partial success", err)
+	}
+}
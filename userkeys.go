@@ -0,0 +1,131 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UserAuthorized authenticates keys by the authorized_keys file of each user
+type UserAuthorized struct {
+	// Path is the template of the file, %h is replaced by the home directory,
+	// %u by the username and %% by a single %, relative paths are in the home directory
+	// If empty, then "%h/.ssh/authorized_keys"
+	Path string
+	// StrictModes refuses files that are not owned by the user or root, or are writable
+	// by others, as are their parent directories up to the home directory
+	StrictModes bool
+	// Logger error log
+	Logger Logger
+
+	mut   sync.Mutex
+	cache map[string]userAuthorizedEntry
+}
+
+type userAuthorizedEntry struct {
+	modTime    time.Time
+	size       int64
+	authorized *Authorized
+}
+
+func (u *UserAuthorized) path() string {
+	if u.Path == "" {
+		return "%h/.ssh/authorized_keys"
+	}
+	return u.Path
+}
+
+// PublicKeyCallback authenticates the key with the authorized_keys file of the user,
+// it can be used as ssh.ServerConfig.PublicKeyCallback
+func (u *UserAuthorized) PublicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	authorized, err := u.Authorized(conn.User())
+	if err != nil {
+		if u.Logger != nil {
+			u.Logger.Println("authorized keys of", conn.User(), "refused:", err)
+		}
+		return nil, err
+	}
+	return authorized.PublicKeyCallback(conn, key)
+}
+
+// Authorized returns the keys authorized by the file of the user,
+// the file is only parsed again when its modification time or size changes
+func (u *UserAuthorized) Authorized(name string) (*Authorized, error) {
+	usr, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	path := expandTokens(u.path(), map[string]string{
+		"%h": usr.HomeDir,
+		"%u": usr.Username,
+	}, nil)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(usr.HomeDir, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if u.StrictModes {
+		uid, err := strconv.Atoi(usr.Uid)
+		if err != nil {
+			return nil, err
+		}
+		err = securePath(path, usr.HomeDir, uid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u.mut.Lock()
+	entry, ok := u.cache[path]
+	u.mut.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.authorized, nil
+	}
+
+	authorized, err := GetAuthorizedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	if u.cache == nil {
+		u.cache = map[string]userAuthorizedEntry{}
+	}
+	u.cache[path] = userAuthorizedEntry{
+		modTime:    info.ModTime(),
+		size:       info.Size(),
+		authorized: authorized,
+	}
+	return authorized, nil
+}
+
+// securePath checks the file and its parent directories up to the home directory, or to the
+// root if the file is outside of it, are owned by the uid or root and not writable by others
+func securePath(path, home string, uid int) error {
+	home = filepath.Clean(home)
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		err = secureFile(p, info, uid)
+		if err != nil {
+			return err
+		}
+		if p == home || p == filepath.Dir(p) {
+			return nil
+		}
+	}
+}
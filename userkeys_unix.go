@@ -0,0 +1,20 @@
+//go:build unix
+
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// secureFile checks the file is owned by the uid or root and not writable by others
+func secureFile(path string, info os.FileInfo, uid int) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != uid && stat.Uid != 0 {
+		return fmt.Errorf("bad ownership of %s", path)
+	}
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("bad modes of %s", path)
+	}
+	return nil
+}